@@ -0,0 +1,98 @@
+package goservice
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Requirement is a permission a request must have to reach a handler. Use RequireRole,
+// RequireScope and RequirePredicate to build them, and Authorize to enforce them.
+type Requirement struct {
+	// Name describes the requirement in errors and telemetry, e.g. `role:admin`.
+	Name  string
+	check func(r *http.Request, claims JWTClaims) bool
+}
+
+// RequireRole requires one of the given roles in the token's `roles` or `role` claim.
+func RequireRole(roles ...string) Requirement {
+	return Requirement{
+		Name: "role:" + strings.Join(roles, "|"),
+		check: func(r *http.Request, claims JWTClaims) bool {
+			return containsAny(append(claims.Strings("roles"), claims.Strings("role")...), roles)
+		},
+	}
+}
+
+// RequireScope requires one of the given scopes in the token's `scope` or `scp` claim.
+func RequireScope(scopes ...string) Requirement {
+	return Requirement{
+		Name: "scope:" + strings.Join(scopes, "|"),
+		check: func(r *http.Request, claims JWTClaims) bool {
+			return containsAny(append(claims.Strings("scope"), claims.Strings("scp")...), scopes)
+		},
+	}
+}
+
+// RequirePredicate requires fn to return true. The claims are nil if the request wasn't
+// authenticated by JWTAuth.
+func RequirePredicate(name string, fn func(r *http.Request, claims JWTClaims) bool) Requirement {
+	return Requirement{
+		Name:  name,
+		check: fn,
+	}
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, w := range wanted {
+		if containsString(values, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns a middleware that lets a request through only if it meets every
+// requirement. It should come after JWTAuth in the chain, which provides the claims.
+// Requests without claims that fail a requirement are `unauthorized`; authenticated
+// requests are `forbidden`, with the unmet requirements in the `missing` param. Denials
+// are logged as warnings against the request's log context when a logger is given.
+func Authorize(logger IrisLogger, requirements ...Requirement) Middleware {
+	return func(next HttpRequestHandlerFunc) HttpRequestHandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+			claims, authenticated := ClaimsFrom(r.Context())
+			var missing []string
+			for _, requirement := range requirements {
+				if !requirement.check(r, claims) {
+					missing = append(missing, requirement.Name)
+				}
+			}
+			if len(missing) == 0 {
+				return next(w, r, context)
+			}
+
+			params := map[string]string{
+				"missing": strings.Join(missing, ","),
+			}
+			if logger != nil {
+				logger.Warning("authorization_denied", "request does not meet the route's requirements", map[string]string{
+					"missing":       params["missing"],
+					"method":        r.Method,
+					"path":          r.URL.Path,
+					"authenticated": boolString(authenticated),
+				}, context)
+			}
+			if !authenticated {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				return Unauthorized("authentication_required", "authentication is required", params)
+			}
+			return Forbidden("insufficient_permissions", "missing permissions: "+params["missing"], params)
+		}
+	}
+}
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
@@ -0,0 +1,121 @@
+package goservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// authorize runs the Authorize middleware for a request with the claims, if not nil, and
+// returns its error and whether the next handler was called.
+func authorize(logger IrisLogger, claims JWTClaims, requirements ...Requirement) (*httptest.ResponseRecorder, *IrisError, bool) {
+	called := false
+	handler := Authorize(logger, requirements...)(func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+		called = true
+		return nil
+	})
+	request := httptest.NewRequest("DELETE", "/users/1", nil)
+	if claims != nil {
+		request = request.WithContext(context.WithValue(request.Context(), jwtClaimsKey{}, claims))
+	}
+	recorder := httptest.NewRecorder()
+	err := handler(recorder, request, IrisLogContext{CorrelationId: "correlation"})
+	return recorder, err, called
+}
+
+func TestAuthorizeRequirements(t *testing.T) {
+	claims := JWTClaims{
+		"sub":   "user-1",
+		"roles": []interface{}{"reader", "writer"},
+		"scope": "users:read users:write",
+	}
+	tests := []struct {
+		name        string
+		requirement Requirement
+		allowed     bool
+	}{
+		{"role in roles", RequireRole("admin", "writer"), true},
+		{"role missing", RequireRole("admin"), false},
+		{"role in role claim", RequireRole("reader"), true},
+		{"scope", RequireScope("users:write"), true},
+		{"scope missing", RequireScope("users:delete"), false},
+		{"predicate", RequirePredicate("own_user", func(r *http.Request, claims JWTClaims) bool {
+			return r.URL.Path == "/users/"+claims.String("sub")[len("user-"):]
+		}), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err, called := authorize(nil, claims, test.requirement)
+			if called != test.allowed || (err == nil) != test.allowed {
+				t.Errorf("got %v, called %v, want allowed %v", err, called, test.allowed)
+			}
+		})
+	}
+
+	if _, err, _ := authorize(nil, JWTClaims{"scp": []interface{}{"users:read"}}, RequireScope("users:read")); err != nil {
+		t.Errorf("the scp claim was not used: %v", err)
+	}
+}
+
+func TestAuthorizeDeniesAuthenticatedRequestsAsForbidden(t *testing.T) {
+	logger := &recordingLogger{}
+	claims := JWTClaims{"sub": "user-1", "roles": "reader"}
+	recorder, err, called := authorize(logger, claims, RequireRole("admin"), RequireScope("users:delete"), RequireRole("reader"))
+
+	if called {
+		t.Error("the handler was called")
+	}
+	if err == nil || err.Code != "forbidden.insufficient_permissions" {
+		t.Fatalf("got %v, want forbidden", err)
+	}
+	if err.Params["missing"] != "role:admin,scope:users:delete" {
+		t.Errorf("got missing %q, want the unmet requirements", err.Params["missing"])
+	}
+	if challenge := recorder.Header().Get("WWW-Authenticate"); challenge != "" {
+		t.Errorf("got WWW-Authenticate %q for an authenticated request", challenge)
+	}
+
+	warnings := logger.byKind("warning")
+	if len(warnings) != 1 || warnings[0].Name != "authorization_denied" {
+		t.Fatalf("got warnings %+v, want the denial", warnings)
+	}
+	want := map[string]string{
+		"missing":       "role:admin,scope:users:delete",
+		"method":        "DELETE",
+		"path":          "/users/1",
+		"authenticated": "true",
+	}
+	for k, v := range want {
+		if warnings[0].Data[k] != v {
+			t.Errorf("logged %s = %q, want %q", k, warnings[0].Data[k], v)
+		}
+	}
+	if warnings[0].Context.CorrelationId != "correlation" {
+		t.Error("the denial was not logged against the request's log context")
+	}
+}
+
+func TestAuthorizeDeniesUnauthenticatedRequests(t *testing.T) {
+	logger := &recordingLogger{}
+	recorder, err, called := authorize(logger, nil, RequireRole("admin"))
+
+	if called || err == nil || err.Code != "unauthorized.authentication_required" {
+		t.Fatalf("got %v, called %v, want unauthorized", err, called)
+	}
+	if challenge := recorder.Header().Get("WWW-Authenticate"); challenge != "Bearer" {
+		t.Errorf("got WWW-Authenticate %q, want Bearer", challenge)
+	}
+	if warnings := logger.byKind("warning"); len(warnings) != 1 || warnings[0].Data["authenticated"] != "false" {
+		t.Errorf("got warnings %+v, want an unauthenticated denial", warnings)
+	}
+}
+
+func TestAuthorizePredicateWithoutClaims(t *testing.T) {
+	public := RequirePredicate("internal_network", func(r *http.Request, claims JWTClaims) bool {
+		return claims == nil
+	})
+	if _, err, called := authorize(nil, nil, public); err != nil || !called {
+		t.Errorf("got %v, want a predicate to be able to allow requests without claims", err)
+	}
+}
@@ -0,0 +1,278 @@
+package goservice
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every call through while watching the failure rate.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects every call until the cooldown has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets a few trial calls through to decide whether to close again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerSettings configures a CircuitBreaker. Zero fields are replaced by the
+// defaults noted on them.
+type CircuitBreakerSettings struct {
+	// Name identifies the downstream in errors and telemetry.
+	Name string
+	// Window is how far back calls are counted towards the failure rate. Defaults to 10s.
+	Window time.Duration
+	// MinimumCalls is the number of calls within the window before the circuit can
+	// open, so that a single early failure doesn't trip it. Defaults to 10.
+	MinimumCalls int
+	// FailureRate is the fraction of failed calls, between 0 and 1, that opens the
+	// circuit. Defaults to 0.5.
+	FailureRate float64
+	// Cooldown is how long the circuit stays open before trying again. Defaults to 30s.
+	Cooldown time.Duration
+	// HalfOpenCalls is the number of trial calls that must succeed to close the circuit.
+	// Defaults to 1.
+	HalfOpenCalls int
+	// Logger receives a metric and a warning on each state change. Optional.
+	Logger IrisLogger
+}
+
+func (settings CircuitBreakerSettings) withDefaults() CircuitBreakerSettings {
+	if settings.Window <= 0 {
+		settings.Window = 10 * time.Second
+	}
+	if settings.MinimumCalls <= 0 {
+		settings.MinimumCalls = 10
+	}
+	if settings.FailureRate <= 0 || settings.FailureRate > 1 {
+		settings.FailureRate = 0.5
+	}
+	if settings.Cooldown <= 0 {
+		settings.Cooldown = 30 * time.Second
+	}
+	if settings.HalfOpenCalls <= 0 {
+		settings.HalfOpenCalls = 1
+	}
+	return settings
+}
+
+// circuitBuckets is the number of buckets the window is split into.
+const circuitBuckets = 10
+
+type circuitBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// CircuitBreaker stops calls to a downstream that keeps failing, giving it time to
+// recover. Only retryable IrisErrors count as failures, since other errors such as bad
+// requests or cancelled contexts say nothing about the health of the downstream. It is
+// safe for concurrent use.
+type CircuitBreaker struct {
+	settings CircuitBreakerSettings
+
+	mu                sync.Mutex
+	state             CircuitState
+	buckets           []circuitBucket
+	openedAt          time.Time
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+
+	// generation changes with every state change, so that calls admitted in an earlier
+	// state are not counted in the current one.
+	generation uint64
+}
+
+// NewCircuitBreaker creates a closed circuit breaker.
+func NewCircuitBreaker(settings CircuitBreakerSettings) *CircuitBreaker {
+	return &CircuitBreaker{
+		settings: settings.withDefaults(),
+	}
+}
+
+// State returns the current state of the circuit.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && !currentClock.Now().Before(b.openedAt.Add(b.settings.Cooldown)) {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// Execute calls fn if the circuit allows it, and records the outcome. When the circuit is
+// open, or half open with its trial calls already in flight, fn is not called and an
+// `unavailable.circuit_open` error is returned, with a `retry_after` param set to the
+// remaining cooldown. A panic in fn counts as a failure, and is passed on. The log context
+// is taken from ctx, see `WithLogContext`.
+func (b *CircuitBreaker) Execute(ctx context.Context, fn func(ctx context.Context) error) error {
+	generation, err := b.allow(ctx)
+	if err != nil {
+		return err
+	}
+	returned := false
+	defer func() {
+		if !returned {
+			b.record(ctx, generation, false)
+		}
+	}()
+	callErr := fn(ctx)
+	returned = true
+	b.record(ctx, generation, !isCircuitFailure(callErr))
+	return callErr
+}
+
+// isCircuitFailure returns whether err counts as a failure of the downstream.
+func isCircuitFailure(err error) bool {
+	_, ok := As(err)
+	return ok && isRetryable(err)
+}
+
+// allow returns the generation the call is admitted in, or an error if it isn't.
+func (b *CircuitBreaker) allow(ctx context.Context) (uint64, *IrisError) {
+	b.mu.Lock()
+	now := currentClock.Now()
+	from := b.state
+	var err *IrisError
+	if b.state == CircuitOpen {
+		reopensAt := b.openedAt.Add(b.settings.Cooldown)
+		if now.Before(reopensAt) {
+			err = b.openError(reopensAt.Sub(now))
+		} else {
+			b.state = CircuitHalfOpen
+			b.generation++
+			b.halfOpenInFlight = 0
+			b.halfOpenSuccesses = 0
+		}
+	}
+	if b.state == CircuitHalfOpen {
+		if b.halfOpenInFlight+b.halfOpenSuccesses >= b.settings.HalfOpenCalls {
+			err = b.openError(0)
+		} else {
+			b.halfOpenInFlight++
+		}
+	}
+	to, generation := b.state, b.generation
+	b.mu.Unlock()
+	b.changed(ctx, from, to)
+	return generation, err
+}
+
+func (b *CircuitBreaker) openError(wait time.Duration) *IrisError {
+	message := "circuit breaker is open"
+	if b.settings.Name != "" {
+		message = fmt.Sprintf("circuit breaker %s is open", b.settings.Name)
+	}
+	return Unavailable("circuit_open", message, map[string]string{
+		"circuit":         b.settings.Name,
+		PARAM_RETRY_AFTER: strconv.Itoa(int(math.Ceil(wait.Seconds()))),
+	})
+}
+
+// record counts the outcome of a call admitted in generation. Calls admitted before the
+// last state change are ignored: a slow call from when the circuit was closed is not a
+// trial call of the half open circuit.
+func (b *CircuitBreaker) record(ctx context.Context, generation uint64, success bool) {
+	b.mu.Lock()
+	if generation != b.generation {
+		b.mu.Unlock()
+		return
+	}
+	now := currentClock.Now()
+	from := b.state
+	switch b.state {
+	case CircuitHalfOpen:
+		b.halfOpenInFlight--
+		if !success {
+			b.open(now)
+		} else if b.halfOpenSuccesses++; b.halfOpenSuccesses >= b.settings.HalfOpenCalls {
+			b.state = CircuitClosed
+			b.generation++
+			b.buckets = nil
+		}
+	case CircuitClosed:
+		b.count(now, success)
+		successes, failures := b.totals(now)
+		calls := successes + failures
+		if calls >= b.settings.MinimumCalls && float64(failures)/float64(calls) >= b.settings.FailureRate {
+			b.open(now)
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.changed(ctx, from, to)
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.state = CircuitOpen
+	b.generation++
+	b.openedAt = now
+	b.buckets = nil
+}
+
+// count adds the outcome to the bucket for now, dropping buckets that left the window.
+func (b *CircuitBreaker) count(now time.Time, success bool) {
+	b.expire(now)
+	width := b.settings.Window / circuitBuckets
+	if len(b.buckets) == 0 || !now.Before(b.buckets[len(b.buckets)-1].start.Add(width)) {
+		b.buckets = append(b.buckets, circuitBucket{start: now})
+	}
+	bucket := &b.buckets[len(b.buckets)-1]
+	if success {
+		bucket.successes++
+	} else {
+		bucket.failures++
+	}
+}
+
+func (b *CircuitBreaker) expire(now time.Time) {
+	cutoff := now.Add(-b.settings.Window)
+	i := 0
+	for i < len(b.buckets) && !b.buckets[i].start.After(cutoff) {
+		i++
+	}
+	b.buckets = b.buckets[i:]
+}
+
+func (b *CircuitBreaker) totals(now time.Time) (int, int) {
+	b.expire(now)
+	successes, failures := 0, 0
+	for _, bucket := range b.buckets {
+		successes += bucket.successes
+		failures += bucket.failures
+	}
+	return successes, failures
+}
+
+// changed reports a state change as a metric holding the new state, and a warning.
+func (b *CircuitBreaker) changed(ctx context.Context, from CircuitState, to CircuitState) {
+	if from == to || b.settings.Logger == nil {
+		return
+	}
+	logContext := LogContextFrom(ctx)
+	b.settings.Logger.Metric("circuit_breaker."+b.settings.Name+".state", float64(to), logContext)
+	b.settings.Logger.Warning("circuit_breaker_state_changed", fmt.Sprintf("circuit breaker %s changed from %s to %s", b.settings.Name, from, to), map[string]string{
+		"circuit": b.settings.Name,
+		"from":    from.String(),
+		"to":      to.String(),
+	}, logContext)
+}
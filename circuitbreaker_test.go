@@ -0,0 +1,226 @@
+package goservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+)
+
+// useFakeClock replaces the package clock for the duration of a test.
+func useFakeClock(t *testing.T) *fakeclock.FakeClock {
+	fake := fakeclock.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	previous := currentClock
+	currentClock = fake
+	t.Cleanup(func() { currentClock = previous })
+	return fake
+}
+
+func failing(context.Context) error {
+	return Unavailable("downstream", "downstream is down", nil)
+}
+
+func succeeding(context.Context) error {
+	return nil
+}
+
+func newTestBreaker() *CircuitBreaker {
+	return NewCircuitBreaker(CircuitBreakerSettings{
+		Name:         "billing",
+		Window:       10 * time.Second,
+		MinimumCalls: 4,
+		FailureRate:  0.5,
+		Cooldown:     30 * time.Second,
+	})
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	clock := useFakeClock(t)
+	breaker := newTestBreaker()
+	ctx := context.Background()
+
+	breaker.Execute(ctx, succeeding)
+	breaker.Execute(ctx, succeeding)
+	breaker.Execute(ctx, failing)
+	if breaker.State() != CircuitClosed {
+		t.Fatalf("state %s before MinimumCalls, want closed", breaker.State())
+	}
+	breaker.Execute(ctx, failing)
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("state %s at a failure rate of 0.5, want open", breaker.State())
+	}
+
+	called := false
+	err := breaker.Execute(ctx, func(context.Context) error {
+		called = true
+		return nil
+	})
+	if called {
+		t.Error("an open circuit called fn")
+	}
+	if !Is(err, ERROR_UNAVAILABLE, "circuit_open") {
+		t.Errorf("got %v, want unavailable.circuit_open", err)
+	}
+	if wait, ok := retryAfterHint(err); !ok || wait != 30*time.Second {
+		t.Errorf("got retry_after %v, want the cooldown", wait)
+	}
+
+	clock.Increment(30 * time.Second)
+	if breaker.State() != CircuitHalfOpen {
+		t.Fatalf("state %s after the cooldown, want half open", breaker.State())
+	}
+	if err := breaker.Execute(ctx, succeeding); err != nil {
+		t.Fatalf("trial call returned %v", err)
+	}
+	if breaker.State() != CircuitClosed {
+		t.Errorf("state %s after a successful trial, want closed", breaker.State())
+	}
+}
+
+func TestCircuitBreakerReopensOnFailedTrial(t *testing.T) {
+	clock := useFakeClock(t)
+	breaker := newTestBreaker()
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		breaker.Execute(ctx, failing)
+	}
+	clock.Increment(30 * time.Second)
+	breaker.Execute(ctx, failing)
+	if breaker.State() != CircuitOpen {
+		t.Errorf("state %s after a failed trial, want open", breaker.State())
+	}
+}
+
+func TestCircuitBreakerForgetsOldCalls(t *testing.T) {
+	clock := useFakeClock(t)
+	breaker := newTestBreaker()
+	ctx := context.Background()
+
+	breaker.Execute(ctx, failing)
+	breaker.Execute(ctx, failing)
+	breaker.Execute(ctx, failing)
+	clock.Increment(11 * time.Second)
+	breaker.Execute(ctx, failing)
+	if breaker.State() != CircuitClosed {
+		t.Errorf("state %s, want closed as the first failures left the window", breaker.State())
+	}
+}
+
+func TestCircuitBreakerCountsOnlyRetryableIrisErrors(t *testing.T) {
+	useFakeClock(t)
+	breaker := newTestBreaker()
+	ctx := context.Background()
+
+	for _, err := range []error{
+		BadRequest("invalid", "bad input", nil),
+		errors.New("plain error"),
+		context.Canceled,
+		Wrap(context.DeadlineExceeded, nil),
+	} {
+		err := err
+		for i := 0; i < 4; i++ {
+			breaker.Execute(ctx, func(context.Context) error { return err })
+		}
+	}
+	if breaker.State() != CircuitClosed {
+		t.Errorf("state %s, want closed as no error counted as a failure", breaker.State())
+	}
+}
+
+func TestCircuitBreakerIgnoresCallsFromEarlierStates(t *testing.T) {
+	clock := useFakeClock(t)
+	breaker := newTestBreaker()
+	ctx := context.Background()
+
+	// A slow call is admitted while the circuit is closed.
+	slowStarted := make(chan struct{})
+	finishSlow := make(chan struct{})
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		breaker.Execute(ctx, func(context.Context) error {
+			close(slowStarted)
+			<-finishSlow
+			return nil
+		})
+	}()
+	<-slowStarted
+
+	for i := 0; i < 4; i++ {
+		breaker.Execute(ctx, failing)
+	}
+	clock.Increment(30 * time.Second)
+
+	// A trial call is admitted, and the slow call finishes while it is in flight.
+	trialStarted := make(chan struct{})
+	finishTrial := make(chan struct{})
+	trialDone := make(chan struct{})
+	go func() {
+		defer close(trialDone)
+		breaker.Execute(ctx, func(context.Context) error {
+			close(trialStarted)
+			<-finishTrial
+			return failing(ctx)
+		})
+	}()
+	<-trialStarted
+	close(finishSlow)
+	<-slowDone
+
+	if breaker.State() != CircuitHalfOpen {
+		t.Errorf("state %s after the slow call finished, want half open", breaker.State())
+	}
+	if err := breaker.Execute(ctx, succeeding); !Is(err, ERROR_UNAVAILABLE, "circuit_open") {
+		t.Errorf("got %v, want the trial call to still be in flight", err)
+	}
+
+	close(finishTrial)
+	<-trialDone
+	if breaker.State() != CircuitOpen {
+		t.Errorf("state %s after the trial failed, want open", breaker.State())
+	}
+}
+
+func TestCircuitBreakerCountsPanicsAsFailures(t *testing.T) {
+	clock := useFakeClock(t)
+	breaker := newTestBreaker()
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		breaker.Execute(ctx, failing)
+	}
+	clock.Increment(30 * time.Second)
+	func() {
+		defer func() {
+			if recover() != "trial panicked" {
+				t.Error("the panic was not passed on")
+			}
+		}()
+		breaker.Execute(ctx, func(context.Context) error { panic("trial panicked") })
+	}()
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("state %s after a trial panicked, want open", breaker.State())
+	}
+
+	// The panicking trial must not hold its half open slot forever.
+	clock.Increment(30 * time.Second)
+	if err := breaker.Execute(ctx, succeeding); err != nil {
+		t.Fatalf("trial call after the cooldown returned %v", err)
+	}
+	if breaker.State() != CircuitClosed {
+		t.Errorf("state %s after a successful trial, want closed", breaker.State())
+	}
+}
+
+func TestCircuitBreakerOpenErrorWithoutName(t *testing.T) {
+	useFakeClock(t)
+	breaker := NewCircuitBreaker(CircuitBreakerSettings{MinimumCalls: 1})
+	breaker.Execute(context.Background(), failing)
+	err := breaker.Execute(context.Background(), succeeding)
+	if iriserr, ok := As(err); !ok || iriserr.Message != "circuit breaker is open" {
+		t.Errorf("got %v, want the open error", err)
+	}
+}
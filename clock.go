@@ -4,7 +4,8 @@ package goservice
 
 import "code.cloudfoundry.org/clock"
 
-var currentClock clock.Clock
+// currentClock starts out as the real clock so helpers work before NewLogger is called.
+var currentClock clock.Clock = clock.NewClock()
 
 func initClock() {
 	currentClock = clock.NewClock()
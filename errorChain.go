@@ -0,0 +1,136 @@
+package goservice
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ChainEntry is a single error in a causal chain, as returned by `Flatten`.
+// Errors that are not IrisErrors only carry a Type and Message.
+type ChainEntry struct {
+	Type      string            `json:"type"`
+	TypeCode  string            `json:"typecode,omitempty"`
+	Code      string            `json:"code,omitempty"`
+	Message   string            `json:"message"`
+	Params    map[string]string `json:"params,omitempty"`
+	Retryable *bool             `json:"is_retryable,omitempty"`
+}
+
+// maxChainLength bounds the errors that Root and Walk visit, so that an error that wraps
+// itself doesn't make them loop forever.
+const maxChainLength = 1000
+
+// Cause returns the error directly wrapped by err, or nil if there is none.
+// Errors implementing `Unwrap() []error` return their first wrapped error.
+func Cause(err error) error {
+	switch typed := err.(type) {
+	case interface{ Unwrap() error }:
+		return typed.Unwrap()
+	case interface{ Unwrap() []error }:
+		for _, e := range typed.Unwrap() {
+			if e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// Root follows `Cause` until it reaches the innermost error of the chain, or gives up after
+// maxChainLength errors.
+func Root(err error) error {
+	for i := 0; err != nil && i < maxChainLength; i++ {
+		next := Cause(err)
+		if next == nil {
+			return err
+		}
+		err = next
+	}
+	return err
+}
+
+// Walk visits err and every error it wraps, depth first, using the standard `Unwrap`
+// methods so chains mixing IrisErrors and other errors are followed all the way down.
+// Errors implementing `Unwrap() []error` have each of their branches visited in order.
+// Returning false from fn stops the walk, as does visiting maxChainLength errors.
+func Walk(err error, fn func(err error) bool) {
+	visited := 0
+	walk(err, fn, &visited)
+}
+
+func walk(err error, fn func(err error) bool, visited *int) bool {
+	if err == nil {
+		return true
+	}
+	if *visited >= maxChainLength {
+		return false
+	}
+	*visited++
+	if !fn(err) {
+		return false
+	}
+	switch typed := err.(type) {
+	case interface{ Unwrap() error }:
+		return walk(typed.Unwrap(), fn, visited)
+	case interface{ Unwrap() []error }:
+		for _, e := range typed.Unwrap() {
+			if !walk(e, fn, visited) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ChainParams merges the params of every IrisError in the chain. When the same key
+// appears more than once, the outermost error wins, matching `Augment`.
+func ChainParams(err error) map[string]string {
+	params := map[string]string{}
+	Walk(err, func(err error) bool {
+		if iriserr, ok := err.(*IrisError); ok {
+			for k, v := range iriserr.Params {
+				if _, exists := params[k]; !exists {
+					params[k] = v
+				}
+			}
+		}
+		return true
+	})
+	return params
+}
+
+// Flatten returns every error in the chain, outermost first, in a form suitable for
+// structured logging.
+func Flatten(err error) []ChainEntry {
+	entries := []ChainEntry{}
+	Walk(err, func(err error) bool {
+		switch typed := err.(type) {
+		case *IrisError:
+			entries = append(entries, ChainEntry{
+				Type:      fmt.Sprintf("%T", typed),
+				TypeCode:  typed.TypeCode,
+				Code:      typed.Code,
+				Message:   typed.Message,
+				Params:    typed.Params,
+				Retryable: typed.IsRetryable,
+			})
+		default:
+			entries = append(entries, ChainEntry{
+				Type:    fmt.Sprintf("%T", typed),
+				Message: typed.Error(),
+			})
+		}
+		return true
+	})
+	return entries
+}
+
+// ChainJSON renders the output of `Flatten` as a JSON string, so a whole causal chain
+// can be attached to the data map passed to IrisLogger.
+func ChainJSON(err error) string {
+	bytes, marshalErr := json.Marshal(Flatten(err))
+	if marshalErr != nil {
+		return "[]"
+	}
+	return string(bytes)
+}
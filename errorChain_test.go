@@ -0,0 +1,135 @@
+package goservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// cyclicError is an error that wraps itself, which would make a naive walk loop forever.
+type cyclicError struct{}
+
+func (err *cyclicError) Error() string { return "cycle" }
+
+func (err *cyclicError) Unwrap() error { return err }
+
+// chainOf returns the outermost error of a chain mixing IrisErrors and other errors: an
+// internal error augmenting a fmt error, wrapping a bad request that wraps io.EOF.
+func chainOf() (outer error, badRequest *IrisError) {
+	badRequest = WrapWithCode(io.EOF, map[string]string{"field": "name", "shared": "inner"}, ERROR_BAD_REQUEST).(*IrisError)
+	wrapped := fmt.Errorf("decoding: %w", badRequest)
+	return Augment(wrapped, "handling request", map[string]string{"shared": "outer"}), badRequest
+}
+
+func TestCauseAndRoot(t *testing.T) {
+	outer, badRequest := chainOf()
+
+	wrapped := Cause(outer)
+	if Cause(wrapped) != badRequest {
+		t.Errorf("Cause of %v = %v, want the bad request", wrapped, Cause(wrapped))
+	}
+	if Root(outer) != io.EOF {
+		t.Errorf("Root = %v, want io.EOF", Root(outer))
+	}
+	if Cause(io.EOF) != nil || Root(nil) != nil {
+		t.Error("errors without a cause should have none")
+	}
+	if Root(io.EOF) != io.EOF {
+		t.Error("an error without a cause is its own root")
+	}
+
+	joined := errors.Join(nil, io.EOF, io.ErrUnexpectedEOF)
+	if Cause(joined) != io.EOF {
+		t.Errorf("Cause of joined errors = %v, want the first one", Cause(joined))
+	}
+}
+
+func TestWalkVisitsEveryErrorOutermostFirst(t *testing.T) {
+	outer, _ := chainOf()
+	var visited []string
+	Walk(errors.Join(outer, io.ErrClosedPipe), func(err error) bool {
+		visited = append(visited, fmt.Sprintf("%T", err))
+		return true
+	})
+	want := []string{"*errors.joinError", "*goservice.IrisError", "*fmt.wrapError", "*goservice.IrisError", "*errors.errorString", "*errors.errorString"}
+	if fmt.Sprint(visited) != fmt.Sprint(want) {
+		t.Errorf("visited %v, want %v", visited, want)
+	}
+
+	count := 0
+	Walk(outer, func(err error) bool {
+		count++
+		return count < 2
+	})
+	if count != 2 {
+		t.Errorf("visited %d errors after being stopped at 2", count)
+	}
+}
+
+func TestWalkStopsOnCycles(t *testing.T) {
+	count := 0
+	Walk(fmt.Errorf("outer: %w", &cyclicError{}), func(err error) bool {
+		count++
+		return true
+	})
+	if count != maxChainLength {
+		t.Errorf("visited %d errors, want %d", count, maxChainLength)
+	}
+	if _, ok := Root(&cyclicError{}).(*cyclicError); !ok {
+		t.Error("Root of a cycle should give up on an error of the cycle")
+	}
+}
+
+func TestWalkFollowsDeepChains(t *testing.T) {
+	var err error = io.EOF
+	for i := 0; i < 500; i++ {
+		err = Augment(err, fmt.Sprintf("level %d", i), nil)
+	}
+	if Root(err) != io.EOF {
+		t.Errorf("Root = %v, want io.EOF", Root(err))
+	}
+	if !Is(err, ERROR_INTERNAL_SERVICE) || !errors.Is(err, io.EOF) {
+		t.Error("the root of a deep chain was not found")
+	}
+}
+
+func TestChainParams(t *testing.T) {
+	outer, _ := chainOf()
+	params := ChainParams(outer)
+	if params["field"] != "name" || params["shared"] != "outer" {
+		t.Errorf("got %v, want the params of every error with the outermost winning", params)
+	}
+}
+
+func TestFlattenAndChainJSON(t *testing.T) {
+	outer, _ := chainOf()
+	entries := Flatten(outer)
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries, want 4: %+v", len(entries), entries)
+	}
+	if entries[0].TypeCode != ERROR_INTERNAL_SERVICE || entries[0].Message != "handling request" || entries[0].Params["shared"] != "outer" {
+		t.Errorf("outer entry = %+v", entries[0])
+	}
+	if entries[1].TypeCode != "" || entries[1].Message != "decoding: bad_request: EOF" {
+		t.Errorf("entry of the fmt error = %+v, want only its type and message", entries[1])
+	}
+	if entries[2].TypeCode != ERROR_BAD_REQUEST || entries[2].Retryable == nil || *entries[2].Retryable {
+		t.Errorf("bad request entry = %+v, want it not retryable", entries[2])
+	}
+	if entries[3].Type != "*errors.errorString" || entries[3].Message != "EOF" {
+		t.Errorf("root entry = %+v", entries[3])
+	}
+
+	var decoded []ChainEntry
+	if err := json.Unmarshal([]byte(ChainJSON(outer)), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 4 || decoded[3].Message != "EOF" {
+		t.Errorf("ChainJSON decoded to %+v", decoded)
+	}
+	if ChainJSON(nil) != "[]" {
+		t.Errorf("ChainJSON(nil) = %s, want []", ChainJSON(nil))
+	}
+}
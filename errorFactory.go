@@ -15,7 +15,9 @@ func Wrap(err error, params map[string]string) error {
 }
 
 // WrapWithCode wraps an error with a custom error code. If `err` is already
-// an `IrisError`, it will add the params passed in to the params of the error
+// an `IrisError`, it will add the params passed in to the params of the error.
+// Otherwise the original error is kept as the cause, so `errors.Is` and `errors.As`
+// can still find it.
 func WrapWithCode(err error, params map[string]string, code string) error {
 	if err == nil {
 		return nil
@@ -24,7 +26,9 @@ func WrapWithCode(err error, params map[string]string, code string) error {
 	case *IrisError:
 		return addParams(err, params)
 	default:
-		return errorFactory(code, code, err.Error(), params)
+		wrapped := errorFactory(code, code, err.Error(), params)
+		wrapped.cause = err
+		return wrapped
 	}
 }
 
@@ -58,6 +62,12 @@ func NotFound(code, message string, params map[string]string) *IrisError {
 	return errorFactory(ERROR_NOT_FOUND, errCode(ERROR_NOT_FOUND, code), message, params)
 }
 
+// MethodNotAllowed creates a new error representing a resource that exists, but does not
+// support the HTTP method of the request
+func MethodNotAllowed(code, message string, params map[string]string) *IrisError {
+	return errorFactory(ERROR_METHOD_NOT_ALLOWED, errCode(ERROR_METHOD_NOT_ALLOWED, code), message, params)
+}
+
 // Forbidden creates a new error representing a resource that cannot be accessed with
 // the current authorisation credentials. The user may need authorising, or if authorised,
 // may not be permitted to perform this action
@@ -71,6 +81,18 @@ func Unauthorized(code, message string, params map[string]string) *IrisError {
 	return errorFactory(ERROR_UNAUTHORIZED, errCode(ERROR_UNAUTHORIZED, code), message, params)
 }
 
+// TooManyRequests creates a new error indicating that the client has sent too many requests
+// and should slow down. Set the `retry_after` param to tell the client when to try again.
+func TooManyRequests(code, message string, params map[string]string) *IrisError {
+	return errorFactory(ERROR_TOO_MANY_REQUESTS, errCode(ERROR_TOO_MANY_REQUESTS, code), message, params)
+}
+
+// Unavailable creates a new error indicating that a service cannot handle the request
+// right now, e.g. because it is overloaded or a circuit breaker is open. This is retryable.
+func Unavailable(code, message string, params map[string]string) *IrisError {
+	return errorFactory(ERROR_UNAVAILABLE, errCode(ERROR_UNAVAILABLE, code), message, params)
+}
+
 // PreconditionFailed creates a new error indicating that one or more conditions
 // given in the request evaluated to false when tested on the server.
 func PreconditionFailed(code, message string, params map[string]string) *IrisError {
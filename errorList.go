@@ -0,0 +1,114 @@
+package goservice
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrorListItem is a single error held by an ErrorList, together with the path of the
+// field it relates to. The field is empty for errors that are not tied to a field.
+type ErrorListItem struct {
+	Field string `json:"field,omitempty"`
+	*IrisError
+}
+
+// ErrorList collects several errors so they can be returned together, e.g. every invalid
+// field of a request rather than only the first one. The zero value is ready to use.
+// Call Err once done to get an IrisError that can be returned from a handler.
+type ErrorList struct {
+	items []ErrorListItem
+}
+
+// Add appends err to the list. Errors that are not IrisErrors are wrapped with `Wrap`,
+// and nil errors are ignored so the result of a check can be added unconditionally.
+func (l *ErrorList) Add(field string, err error) {
+	if err == nil {
+		return
+	}
+	iriserr, ok := err.(*IrisError)
+	if !ok {
+		iriserr = Wrap(err, nil).(*IrisError)
+	}
+	l.items = append(l.items, ErrorListItem{Field: field, IrisError: iriserr})
+}
+
+// Len returns the number of errors in the list.
+func (l *ErrorList) Len() int {
+	return len(l.items)
+}
+
+// Items returns the errors in the order they were added.
+func (l *ErrorList) Items() []ErrorListItem {
+	items := make([]ErrorListItem, len(l.items))
+	copy(items, l.items)
+	return items
+}
+
+// TypeCode returns the type code that best describes the whole list. If every error shares
+// a type code, that is used. Otherwise the list is a `bad_request` when all errors map to
+// client errors, and an `internal_service` error when any of them does not.
+func (l *ErrorList) TypeCode() string {
+	if len(l.items) == 0 {
+		return ""
+	}
+	typeCode := l.items[0].TypeCode
+	clientErrors := true
+	for _, item := range l.items {
+		if item.TypeCode != typeCode {
+			typeCode = ""
+		}
+		if ErrorCodeToStatusCode(item.TypeCode) >= 500 {
+			clientErrors = false
+		}
+	}
+	if typeCode != "" {
+		return typeCode
+	}
+	if clientErrors {
+		return ERROR_BAD_REQUEST
+	}
+	return ERROR_INTERNAL_SERVICE
+}
+
+// Error returns the messages of every error in the list, separated by semicolons.
+func (l *ErrorList) Error() string {
+	messages := make([]string, 0, len(l.items))
+	for _, item := range l.items {
+		if item.Field != "" {
+			messages = append(messages, item.Field+": "+item.IrisError.Error())
+		} else {
+			messages = append(messages, item.IrisError.Error())
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns every error in the list, which lets `Is`, `Walk` and `errors.Is` look
+// inside it.
+func (l *ErrorList) Unwrap() []error {
+	errs := make([]error, len(l.items))
+	for i, item := range l.items {
+		errs[i] = item.IrisError
+	}
+	return errs
+}
+
+// Err returns nil if the list is empty. Otherwise it returns an IrisError with the list's
+// type code and every item in its Errors field, which is how they are serialised to
+// clients. The error is only retryable if every item in the list is.
+func (l *ErrorList) Err() *IrisError {
+	if len(l.items) == 0 {
+		return nil
+	}
+	typeCode := l.TypeCode()
+	err := errorFactory(typeCode, errCode(typeCode, "multiple_errors"), fmt.Sprintf("%d errors occurred", len(l.items)), nil)
+	err.IsRetryable = &retryable
+	for _, item := range l.items {
+		if !item.Retryable() {
+			err.IsRetryable = &notRetryable
+		}
+	}
+	err.Errors = l.Items()
+	err.cause = l
+	return err
+}
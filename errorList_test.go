@@ -0,0 +1,122 @@
+package goservice
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestErrorListTypeCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		errs   []error
+		want   string
+		status int
+	}{
+		{"empty", nil, "", 0},
+		{"same type", []error{NotFound("user", "", nil), NotFound("group", "", nil)}, ERROR_NOT_FOUND, 404},
+		{"client errors", []error{BadRequest("name", "", nil), Forbidden("role", "", nil)}, ERROR_BAD_REQUEST, 400},
+		{"any server error", []error{BadRequest("name", "", nil), Unavailable("db", "", nil)}, ERROR_INTERNAL_SERVICE, 500},
+		{"other errors", []error{BadRequest("name", "", nil), io.EOF}, ERROR_INTERNAL_SERVICE, 500},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list := ErrorList{}
+			for _, err := range test.errs {
+				list.Add("", err)
+			}
+			if got := list.TypeCode(); got != test.want {
+				t.Errorf("TypeCode = %q, want %q", got, test.want)
+			}
+			err := list.Err()
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("Err of an empty list = %v, want nil", err)
+				}
+				return
+			}
+			if err.TypeCode != test.want || ErrorCodeToStatusCode(err.TypeCode) != test.status {
+				t.Errorf("Err has type %q, want %q with status %d", err.TypeCode, test.want, test.status)
+			}
+		})
+	}
+}
+
+func TestErrorListIgnoresNilErrors(t *testing.T) {
+	list := ErrorList{}
+	list.Add("name", nil)
+	if list.Len() != 0 || list.Err() != nil {
+		t.Error("a nil error was added")
+	}
+}
+
+func TestErrorListRetryable(t *testing.T) {
+	list := ErrorList{}
+	list.Add("", Unavailable("db", "", nil))
+	list.Add("", Timeout("cache", "", nil))
+	if !list.Err().Retryable() {
+		t.Error("a list of retryable errors should be retryable")
+	}
+	list.Add("name", BadRequest("missing", "", nil))
+	if list.Err().Retryable() {
+		t.Error("a list with an error that is not retryable should not be")
+	}
+}
+
+func TestErrorListJSON(t *testing.T) {
+	list := ErrorList{}
+	list.Add("name", BadRequest("missing", "name is required", nil))
+	list.Add("age", BadRequest("range", "age is out of range", map[string]string{"min": "0"}))
+
+	bytes, err := json.Marshal(list.Err())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		TypeCode string `json:"typecode"`
+		Code     string `json:"code"`
+		Message  string `json:"message"`
+		Errors   []struct {
+			Field    string            `json:"field"`
+			TypeCode string            `json:"typecode"`
+			Code     string            `json:"code"`
+			Message  string            `json:"message"`
+			Params   map[string]string `json:"params"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(bytes, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.TypeCode != ERROR_BAD_REQUEST || body.Code != "bad_request.multiple_errors" || body.Message != "2 errors occurred" {
+		t.Errorf("got %s", bytes)
+	}
+	if len(body.Errors) != 2 {
+		t.Fatalf("got %d items, want 2: %s", len(body.Errors), bytes)
+	}
+	second := body.Errors[1]
+	if second.Field != "age" || second.Code != "bad_request.range" || second.Message != "age is out of range" || second.Params["min"] != "0" {
+		t.Errorf("item rendered as %+v", second)
+	}
+}
+
+func TestErrorListIsAndAs(t *testing.T) {
+	list := ErrorList{}
+	list.Add("name", BadRequest("missing", "", nil))
+	list.Add("file", io.ErrUnexpectedEOF)
+	err := list.Err()
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !errors.Is(&list, io.ErrUnexpectedEOF) {
+		t.Error("errors.Is should find an error added to the list")
+	}
+	if !errors.Is(err, BadRequest("missing", "", nil)) || !Is(err, "bad_request.missing") {
+		t.Error("Is should find an IrisError added to the list")
+	}
+	if Is(err, ERROR_NOT_FOUND) {
+		t.Error("Is found an error that was not added")
+	}
+	var iriserr *IrisError
+	if !errors.As(&list, &iriserr) || iriserr.Code != "bad_request.missing" {
+		t.Errorf("errors.As found %v, want the first item", iriserr)
+	}
+}
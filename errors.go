@@ -1,6 +1,7 @@
 package goservice
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -12,16 +13,21 @@ const (
 	ERROR_BAD_RESPONSE        = "bad_response"
 	ERROR_FORBIDDEN           = "forbidden"
 	ERROR_INTERNAL_SERVICE    = "internal_service"
+	ERROR_METHOD_NOT_ALLOWED  = "method_not_allowed"
 	ERROR_NOT_FOUND           = "not_found"
 	ERROR_PRECONDITION_FAILED = "precondition_failed"
 	ERROR_TIMEOUT             = "timeout"
+	ERROR_TOO_MANY_REQUESTS   = "too_many_requests"
 	ERROR_UNAUTHORIZED        = "unauthorized"
+	ERROR_UNAVAILABLE         = "unavailable"
 	ERROR_UNKNOWN             = "unknown"
 )
 
 var retryableCodes = []string{
 	ERROR_INTERNAL_SERVICE,
 	ERROR_TIMEOUT,
+	ERROR_TOO_MANY_REQUESTS,
+	ERROR_UNAVAILABLE,
 	ERROR_UNKNOWN,
 }
 
@@ -32,9 +38,16 @@ type IrisError struct {
 	Params   map[string]string `json:"params"`
 	//StackFrames Stack             `json:"stack"`
 
+	// PublicMessage is sent to clients instead of Message when set, so that Message can
+	// hold internal details. Catalog messages passed to HttpRequestHandler take precedence.
+	PublicMessage string `json:"-"`
+
 	// exported for serialization, but you should use Retryable to read the value.
 	IsRetryable *bool `json:"is_retryable"`
 
+	// Errors holds the individual errors when this error was built from an ErrorList.
+	Errors []ErrorListItem `json:"errors,omitempty"`
+
 	// Cause is the initial cause of this error, and will be populated
 	// when using the Propagate function. This is intentionally not exported
 	// so that we don't serialize causes and send them across process boundaries.
@@ -55,16 +68,22 @@ func (p *IrisError) Error() string {
 		return p.legacyErrString()
 	}
 	var next error = p
+	previous := p
 	output := strings.Builder{}
 	output.WriteString(p.Code)
 	for next != nil {
-		output.WriteString(": ")
 		switch typed := next.(type) {
 		case *IrisError:
+			output.WriteString(": ")
 			output.WriteString(typed.Message)
+			previous = typed
 			next = typed.cause
 		case error:
-			output.WriteString(typed.Error())
+			// Wrapped errors take their message from the cause, so don't repeat it.
+			if msg := typed.Error(); msg != previous.Message {
+				output.WriteString(": ")
+				output.WriteString(msg)
+			}
 			next = nil
 		}
 	}
@@ -90,6 +109,28 @@ func (p *IrisError) Unwrap() error {
 	return p.cause
 }
 
+// WithPublicMessage returns a copy of the error that shows message to clients, keeping
+// the original message for logs.
+func (p *IrisError) WithPublicMessage(message string) *IrisError {
+	copied := addParams(p, nil)
+	copied.PublicMessage = message
+	return copied
+}
+
+// Is lets `errors.Is` match an IrisError against another IrisError by code. The target's
+// code is treated as a prefix, in the same way as `PrefixMatches`, so a sentinel such as
+// `BadRequest("", "", nil)` matches every bad request regardless of its subcode.
+func (p *IrisError) Is(target error) bool {
+	t, ok := target.(*IrisError)
+	if !ok || t == nil {
+		return false
+	}
+	if p == t {
+		return true
+	}
+	return t.Code != "" && p.PrefixMatches(t.Code)
+}
+
 //// StackTrace returns a slice of program counters taken from the stack frames.
 //// This adapts the terrors package to allow stacks to be reported to Sentry correctly.
 //func (p *IrisError) StackTrace() []uintptr {
@@ -174,11 +215,15 @@ func addParams(err *IrisError, params map[string]string) *IrisError {
 	}
 
 	return &IrisError{
-		Code:    err.Code,
-		Message: err.Message,
-		Params:  copiedParams,
+		TypeCode: err.TypeCode,
+		Code:     err.Code,
+		Message:  err.Message,
+		Params:   copiedParams,
 		//StackFrames: err.StackFrames,
-		IsRetryable: err.IsRetryable,
+		PublicMessage: err.PublicMessage,
+		IsRetryable:   err.IsRetryable,
+		Errors:        err.Errors,
+		cause:         err.cause,
 	}
 }
 
@@ -235,12 +280,15 @@ func Augment(err error, context string, params map[string]string) error {
 		withMergedParams := addParams(err, params)
 		// The underlying terror will already have a stack, so we don't take a new trace here.
 		return &IrisError{
-			Code:    err.Code,
-			Message: context,
-			Params:  withMergedParams.Params,
+			TypeCode: err.TypeCode,
+			Code:     err.Code,
+			Message:  context,
+			Params:   withMergedParams.Params,
 			//StackFrames: Stack{},
-			IsRetryable: err.IsRetryable,
-			cause:       err,
+			PublicMessage: err.PublicMessage,
+			IsRetryable:   err.IsRetryable,
+			Errors:        err.Errors,
+			cause:         err,
 		}
 	default:
 		return NewInternalWithCause(err, context, params, "")
@@ -267,23 +315,30 @@ func Propagate(err error) error {
 
 // Is checks whether an error is a given code. Similarly to `errors.Is`,
 // this unwinds the error stack and checks each underlying error for the code.
-// If any match, this returns true.
+// If any match, this returns true. Errors that are not IrisErrors are unwrapped
+// too, so an IrisError wrapped by `fmt.Errorf("...: %w", err)` is still found.
 // We prefer this over using a method receiver on the terrors Error, as the function
 // signature requires an error to test against, and checking against terrors would
 // requite creating a new terror with the specific code.
 // WARNING: This function is considered experimental, and may be changed without notice.
 func Is(err error, code ...string) bool {
-	switch err := err.(type) {
-	case *IrisError:
-		if err.PrefixMatches(code...) {
-			return true
+	found := false
+	Walk(err, func(err error) bool {
+		if iriserr, ok := err.(*IrisError); ok && iriserr.PrefixMatches(code...) {
+			found = true
 		}
-		next := err.Unwrap()
-		if next == nil {
-			return false
-		}
-		return Is(next, code...)
-	default:
-		return false
+		return !found
+	})
+	return found
+}
+
+// As finds the first IrisError in the causal chain of err. It is a shorthand for
+// `errors.As` with an `*IrisError` target.
+// WARNING: This function is considered experimental, and may be changed without notice.
+func As(err error) (*IrisError, bool) {
+	var iriserr *IrisError
+	if errors.As(err, &iriserr) {
+		return iriserr, true
 	}
+	return nil, false
 }
@@ -0,0 +1,221 @@
+package goservice
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestWrapKeepsCause(t *testing.T) {
+	cause := fmt.Errorf("reading config: %w", io.EOF)
+	err := Wrap(cause, map[string]string{"file": "config.json"})
+
+	iriserr, ok := err.(*IrisError)
+	if !ok {
+		t.Fatalf("Wrap returned %T, want *IrisError", err)
+	}
+	if iriserr.TypeCode != ERROR_INTERNAL_SERVICE || iriserr.Code != ERROR_INTERNAL_SERVICE {
+		t.Errorf("TypeCode %q and Code %q, want %q", iriserr.TypeCode, iriserr.Code, ERROR_INTERNAL_SERVICE)
+	}
+	if iriserr.Unwrap() != cause {
+		t.Errorf("Unwrap returned %v, want the wrapped error", iriserr.Unwrap())
+	}
+	if iriserr.Params["file"] != "config.json" {
+		t.Errorf("params %v are missing file", iriserr.Params)
+	}
+}
+
+func TestWrapWithCodeKeepsCause(t *testing.T) {
+	cause := errors.New("no rows")
+	err := WrapWithCode(cause, nil, ERROR_NOT_FOUND)
+
+	iriserr, ok := err.(*IrisError)
+	if !ok {
+		t.Fatalf("WrapWithCode returned %T, want *IrisError", err)
+	}
+	if iriserr.TypeCode != ERROR_NOT_FOUND || iriserr.Code != ERROR_NOT_FOUND {
+		t.Errorf("TypeCode %q and Code %q, want %q", iriserr.TypeCode, iriserr.Code, ERROR_NOT_FOUND)
+	}
+	if iriserr.Unwrap() != cause {
+		t.Errorf("Unwrap returned %v, want the wrapped error", iriserr.Unwrap())
+	}
+	if iriserr.Retryable() {
+		t.Error("a not_found error should not be retryable")
+	}
+}
+
+func TestWrapNil(t *testing.T) {
+	if err := Wrap(nil, nil); err != nil {
+		t.Errorf("Wrap(nil) returned %v", err)
+	}
+	if err := WrapWithCode(nil, nil, ERROR_NOT_FOUND); err != nil {
+		t.Errorf("WrapWithCode(nil) returned %v", err)
+	}
+	if err := Augment(nil, "context", nil); err != nil {
+		t.Errorf("Augment(nil) returned %v", err)
+	}
+}
+
+func TestWrapIrisErrorAddsParams(t *testing.T) {
+	original := BadRequest("missing_param", "name is required", map[string]string{"param": "name"})
+	err := Wrap(original, map[string]string{"route": "/users"}).(*IrisError)
+
+	if err == original {
+		t.Fatal("Wrap returned the original error, want a copy")
+	}
+	if err.TypeCode != ERROR_BAD_REQUEST || err.Code != "bad_request.missing_param" {
+		t.Errorf("TypeCode %q and Code %q changed", err.TypeCode, err.Code)
+	}
+	if err.Params["param"] != "name" || err.Params["route"] != "/users" {
+		t.Errorf("params %v were not merged", err.Params)
+	}
+	if _, ok := original.Params["route"]; ok {
+		t.Error("Wrap changed the params of the original error")
+	}
+}
+
+func TestErrorsIsAndAs(t *testing.T) {
+	err := Wrap(fmt.Errorf("query: %w", io.ErrUnexpectedEOF), nil)
+	err = Augment(err, "loading user", nil)
+	err = fmt.Errorf("handler: %w", err)
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("errors.Is did not find the root cause")
+	}
+	if !errors.Is(err, InternalService("", "", nil)) {
+		t.Error("errors.Is did not match an internal_service sentinel")
+	}
+	if errors.Is(err, BadRequest("", "", nil)) {
+		t.Error("errors.Is matched a bad_request sentinel")
+	}
+	if !Is(err, ERROR_INTERNAL_SERVICE) {
+		t.Error("Is did not find the code through a fmt.Errorf wrapper")
+	}
+
+	var iriserr *IrisError
+	if !errors.As(err, &iriserr) {
+		t.Fatal("errors.As did not find an IrisError")
+	}
+	if iriserr.Message != "loading user" {
+		t.Errorf("errors.As found %q, want the outermost IrisError", iriserr.Message)
+	}
+	if found, ok := As(err); !ok || found != iriserr {
+		t.Errorf("As returned %v, %v, want the same error as errors.As", found, ok)
+	}
+}
+
+func TestErrorsIsSubcode(t *testing.T) {
+	err := BadRequest("missing_param", "name is required", nil)
+
+	if !errors.Is(err, BadRequest("missing_param", "", nil)) {
+		t.Error("errors.Is did not match the same subcode")
+	}
+	if errors.Is(err, BadRequest("invalid_param", "", nil)) {
+		t.Error("errors.Is matched another subcode")
+	}
+	if errors.Is(err, &IrisError{}) {
+		t.Error("errors.Is matched an error without a code")
+	}
+}
+
+func TestAugmentKeepsTypeCodeAndCause(t *testing.T) {
+	retryable := false
+	original := Unavailable("db", "database is down", map[string]string{"host": "db1"})
+	original.IsRetryable = &retryable
+
+	err := Augment(original, "loading user", map[string]string{"user": "42"}).(*IrisError)
+
+	if err.TypeCode != ERROR_UNAVAILABLE || err.Code != original.Code {
+		t.Errorf("TypeCode %q and Code %q, want those of the original", err.TypeCode, err.Code)
+	}
+	if err.Message != "loading user" {
+		t.Errorf("Message %q, want the context", err.Message)
+	}
+	if err.Unwrap() != original {
+		t.Errorf("Unwrap returned %v, want the original error", err.Unwrap())
+	}
+	if err.Params["host"] != "db1" || err.Params["user"] != "42" {
+		t.Errorf("params %v were not merged", err.Params)
+	}
+	if err.Retryable() {
+		t.Error("Augment lost the retryability of the original error")
+	}
+}
+
+func TestAugmentWrapsPlainError(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := Augment(cause, "calling billing", nil).(*IrisError)
+
+	if err.TypeCode != ERROR_INTERNAL_SERVICE {
+		t.Errorf("TypeCode %q, want %q", err.TypeCode, ERROR_INTERNAL_SERVICE)
+	}
+	if err.Unwrap() != cause {
+		t.Errorf("Unwrap returned %v, want the plain error", err.Unwrap())
+	}
+}
+
+func TestAddParamsKeepsTypeCodeAndCause(t *testing.T) {
+	cause := errors.New("timeout")
+	original := WrapWithCode(cause, map[string]string{"a": "1"}, ERROR_TIMEOUT).(*IrisError)
+	original.PublicMessage = "try again later"
+
+	copied := addParams(original, map[string]string{"b": "2"})
+
+	if copied.TypeCode != ERROR_TIMEOUT || copied.Code != ERROR_TIMEOUT {
+		t.Errorf("TypeCode %q and Code %q, want %q", copied.TypeCode, copied.Code, ERROR_TIMEOUT)
+	}
+	if copied.Unwrap() != cause {
+		t.Errorf("Unwrap returned %v, want the cause", copied.Unwrap())
+	}
+	if copied.PublicMessage != original.PublicMessage {
+		t.Errorf("PublicMessage %q was not kept", copied.PublicMessage)
+	}
+	if copied.Params["a"] != "1" || copied.Params["b"] != "2" {
+		t.Errorf("params %v were not merged", copied.Params)
+	}
+	if len(original.Params) != 1 {
+		t.Errorf("addParams changed the params of the original error: %v", original.Params)
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "no cause",
+			err:  BadRequest("missing_param", "name is required", nil),
+			want: "bad_request.missing_param: name is required",
+		},
+		{
+			name: "wrapped error is not repeated",
+			err:  Wrap(errors.New("connection refused"), nil),
+			want: "internal_service: connection refused",
+		},
+		{
+			name: "augmented wrapped error",
+			err:  Augment(Wrap(errors.New("connection refused"), nil), "calling billing", nil),
+			want: "internal_service: calling billing: connection refused",
+		},
+		{
+			name: "augmented iris error",
+			err:  Augment(NotFound("user", "no such user", nil), "loading profile", nil),
+			want: "not_found.user: loading profile: no such user",
+		},
+		{
+			name: "plain cause with its own message",
+			err:  NewInternalWithCause(errors.New("EOF"), "reading body", nil, ""),
+			want: "internal_service: reading body: EOF",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.err.Error(); got != test.want {
+				t.Errorf("Error() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
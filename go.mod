@@ -1,3 +1,3 @@
 module github.com/johanohlin/goservice
 
-go 1.15
\ No newline at end of file
+go 1.19
\ No newline at end of file
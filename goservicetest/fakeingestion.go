@@ -0,0 +1,268 @@
+// Package goservicetest has helpers to test services built with goservice. It is kept out
+// of goservice, so that services don't link test code.
+package goservicetest
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Base types of the telemetry received by a FakeIngestion.
+const (
+	TELEMETRY_REQUEST      = "RequestData"
+	TELEMETRY_DEPENDENCY   = "RemoteDependencyData"
+	TELEMETRY_TRACE        = "MessageData"
+	TELEMETRY_EXCEPTION    = "ExceptionData"
+	TELEMETRY_METRIC       = "MetricData"
+	TELEMETRY_AVAILABILITY = "AvailabilityData"
+	TELEMETRY_EVENT        = "EventData"
+)
+
+// IngestedTelemetry is a telemetry item received by a FakeIngestion.
+type IngestedTelemetry struct {
+	Name     string
+	Time     string
+	IKey     string
+	Tags     map[string]string
+	BaseType string
+	// BaseData is the JSON of the item's data, whose shape depends on BaseType. Request,
+	// Dependency, Trace, Exception, Metric, Availability and Event decode it.
+	BaseData json.RawMessage
+	// Properties are the custom properties of the item.
+	Properties map[string]string
+}
+
+// decode decodes the item's data into v if the item is of the base type.
+func (t IngestedTelemetry) decode(baseType string, v interface{}) bool {
+	return t.BaseType == baseType && json.Unmarshal(t.BaseData, v) == nil
+}
+
+// Request returns the data of a TELEMETRY_REQUEST item, or false for other items.
+func (t IngestedTelemetry) Request() (contracts.RequestData, bool) {
+	data := contracts.RequestData{}
+	return data, t.decode(TELEMETRY_REQUEST, &data)
+}
+
+// Dependency returns the data of a TELEMETRY_DEPENDENCY item, or false for other items.
+func (t IngestedTelemetry) Dependency() (contracts.RemoteDependencyData, bool) {
+	data := contracts.RemoteDependencyData{}
+	return data, t.decode(TELEMETRY_DEPENDENCY, &data)
+}
+
+// Trace returns the data of a TELEMETRY_TRACE item, or false for other items.
+func (t IngestedTelemetry) Trace() (contracts.MessageData, bool) {
+	data := contracts.MessageData{}
+	return data, t.decode(TELEMETRY_TRACE, &data)
+}
+
+// Exception returns the data of a TELEMETRY_EXCEPTION item, or false for other items.
+func (t IngestedTelemetry) Exception() (contracts.ExceptionData, bool) {
+	data := contracts.ExceptionData{}
+	return data, t.decode(TELEMETRY_EXCEPTION, &data)
+}
+
+// Metric returns the data of a TELEMETRY_METRIC item, or false for other items.
+func (t IngestedTelemetry) Metric() (contracts.MetricData, bool) {
+	data := contracts.MetricData{}
+	return data, t.decode(TELEMETRY_METRIC, &data)
+}
+
+// Availability returns the data of a TELEMETRY_AVAILABILITY item, or false for other
+// items.
+func (t IngestedTelemetry) Availability() (contracts.AvailabilityData, bool) {
+	data := contracts.AvailabilityData{}
+	return data, t.decode(TELEMETRY_AVAILABILITY, &data)
+}
+
+// Event returns the data of a TELEMETRY_EVENT item, or false for other items.
+func (t IngestedTelemetry) Event() (contracts.EventData, bool) {
+	data := contracts.EventData{}
+	return data, t.decode(TELEMETRY_EVENT, &data)
+}
+
+// OperationId returns the id of the operation the item belongs to, which is the
+// correlation id of its goservice.IrisLogContext.
+func (t IngestedTelemetry) OperationId() string {
+	return t.Tags[contracts.OperationId]
+}
+
+// FakeIngestion is an Application Insights ingestion endpoint for tests, that keeps what
+// it receives so that the shape of a service's telemetry can be checked. Give its URL to
+// goservice.NewLogger with goservice.WithEndpoint, and Close the logger to send what it
+// has queued.
+type FakeIngestion struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	items    []IngestedTelemetry
+	status   int
+	received chan struct{}
+}
+
+// NewFakeIngestion starts a fake ingestion endpoint. Close it when done.
+func NewFakeIngestion() *FakeIngestion {
+	f := &FakeIngestion{status: http.StatusOK, received: make(chan struct{})}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// URL returns the endpoint to send telemetry to.
+func (f *FakeIngestion) URL() string {
+	return f.server.URL + "/v2/track"
+}
+
+// Close stops the endpoint.
+func (f *FakeIngestion) Close() {
+	f.server.Close()
+}
+
+// SetStatus makes the endpoint respond with status, and keep nothing it receives unless
+// status is 200. Use it to check how a service copes with ingestion failing.
+func (f *FakeIngestion) SetStatus(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+// Reset forgets the telemetry received so far.
+func (f *FakeIngestion) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items = nil
+}
+
+// Telemetry returns the telemetry received, in the order it arrived.
+func (f *FakeIngestion) Telemetry() []IngestedTelemetry {
+	return f.filter(func(IngestedTelemetry) bool { return true })
+}
+
+// ByType returns the telemetry of a base type, such as TELEMETRY_REQUEST.
+func (f *FakeIngestion) ByType(baseType string) []IngestedTelemetry {
+	return f.filter(func(t IngestedTelemetry) bool { return t.BaseType == baseType })
+}
+
+// ByEventCode returns the traces and exceptions logged with the code.
+func (f *FakeIngestion) ByEventCode(code string) []IngestedTelemetry {
+	return f.filter(func(t IngestedTelemetry) bool { return t.Properties["event_code"] == code })
+}
+
+// ByOperationId returns the telemetry of an operation, see IngestedTelemetry.OperationId.
+func (f *FakeIngestion) ByOperationId(operationId string) []IngestedTelemetry {
+	return f.filter(func(t IngestedTelemetry) bool { return t.OperationId() == operationId })
+}
+
+func (f *FakeIngestion) filter(match func(t IngestedTelemetry) bool) []IngestedTelemetry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []IngestedTelemetry
+	for _, t := range f.items {
+		if match(t) {
+			items = append(items, t)
+		}
+	}
+	return items
+}
+
+// WaitFor waits until at least count items have been received, or timeout passes. It
+// returns whether they were.
+func (f *FakeIngestion) WaitFor(count int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		f.mu.Lock()
+		n, received := len(f.items), f.received
+		f.mu.Unlock()
+		if n >= count {
+			return true
+		}
+		select {
+		case <-received:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// ingestedEnvelope is the JSON form of an envelope, with its data left to decode.
+type ingestedEnvelope struct {
+	Name string            `json:"name"`
+	Time string            `json:"time"`
+	IKey string            `json:"iKey"`
+	Tags map[string]string `json:"tags"`
+	Data struct {
+		BaseType string          `json:"baseType"`
+		BaseData json.RawMessage `json:"baseData"`
+	} `json:"data"`
+}
+
+// ingestionResponse is the body of a successful response.
+type ingestionResponse struct {
+	ItemsReceived int           `json:"itemsReceived"`
+	ItemsAccepted int           `json:"itemsAccepted"`
+	Errors        []interface{} `json:"errors"`
+}
+
+func (f *FakeIngestion) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	status := f.status
+	f.mu.Unlock()
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer reader.Close()
+		body = reader
+	}
+
+	var items []IngestedTelemetry
+	decoder := json.NewDecoder(bufio.NewReader(body))
+	for decoder.More() {
+		envelope := ingestedEnvelope{}
+		if err := decoder.Decode(&envelope); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		item := IngestedTelemetry{
+			Name:     envelope.Name,
+			Time:     envelope.Time,
+			IKey:     envelope.IKey,
+			Tags:     envelope.Tags,
+			BaseType: envelope.Data.BaseType,
+			BaseData: envelope.Data.BaseData,
+		}
+		properties := struct {
+			Properties map[string]string `json:"properties"`
+		}{}
+		json.Unmarshal(envelope.Data.BaseData, &properties)
+		item.Properties = properties.Properties
+		items = append(items, item)
+	}
+
+	f.mu.Lock()
+	f.items = append(f.items, items...)
+	close(f.received)
+	f.received = make(chan struct{})
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ingestionResponse{
+		ItemsReceived: len(items),
+		ItemsAccepted: len(items),
+		Errors:        []interface{}{},
+	})
+}
@@ -0,0 +1,74 @@
+package goservicetest
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/johanohlin/goservice"
+)
+
+func TestFakeIngestionReceivesTheTelemetryOfNewLogger(t *testing.T) {
+	f := NewFakeIngestion()
+	defer f.Close()
+	logger := goservice.NewLogger("ikey", "test", goservice.WithEndpoint(f.URL()))
+	context := goservice.IrisLogContext{CorrelationId: "correlation", SpanId: "request"}
+
+	logger.Info("loading_user", "loading user", map[string]string{"user": "1"}, context)
+	logger.Request("GET", "https://example.com/users/1", time.Second, "200", "", context)
+	logger.Info("started", "started", nil, goservice.IrisLogContext{})
+	logger.Error("failed", errors.New("connection refused"), nil, goservice.IrisLogContext{})
+	logger.(goservice.ClosableLogger).Close(time.Second)
+
+	if !f.WaitFor(4, time.Second) {
+		t.Fatalf("got %d items, want 4", len(f.Telemetry()))
+	}
+	requests := f.ByType(TELEMETRY_REQUEST)
+	if len(requests) != 1 {
+		t.Fatalf("got requests %+v, want the request", requests)
+	}
+	if request, ok := requests[0].Request(); !ok || request.ResponseCode != "200" || request.Id != "request" || request.Duration != "0.00:00:01.0000000" {
+		t.Errorf("got request %+v, %v", request, ok)
+	}
+	if _, ok := requests[0].Trace(); ok {
+		t.Error("a request decoded as a trace")
+	}
+	traces := f.ByEventCode("loading_user")
+	if len(traces) != 1 || traces[0].Properties["user"] != "1" {
+		t.Fatalf("got traces %+v, want the info", traces)
+	}
+	if trace, ok := traces[0].Trace(); !ok || trace.Message != "loading user" {
+		t.Errorf("got trace %+v, %v", trace, ok)
+	}
+	exceptions := f.ByEventCode("failed")
+	if len(exceptions) != 1 {
+		t.Fatalf("got exceptions %+v, want the error", exceptions)
+	}
+	if exception, ok := exceptions[0].Exception(); !ok || len(exception.Exceptions) == 0 || exception.Exceptions[0].Message != "connection refused" {
+		t.Errorf("got exception %+v, %v", exception, ok)
+	}
+	if items := f.ByOperationId("correlation"); len(items) != 2 {
+		t.Errorf("got %d items of the operation, want 2", len(items))
+	}
+	if items := f.Telemetry(); items[0].IKey != "ikey" {
+		t.Errorf("got instrumentation key %q", items[0].IKey)
+	}
+}
+
+func TestFakeIngestionFailing(t *testing.T) {
+	f := NewFakeIngestion()
+	defer f.Close()
+	f.SetStatus(http.StatusBadRequest)
+	logger := goservice.NewLogger("ikey", "test", goservice.WithEndpoint(f.URL()))
+
+	logger.Info("started", "started", nil, goservice.IrisLogContext{})
+	logger.(goservice.ClosableLogger).Close(time.Second)
+
+	if items := f.Telemetry(); len(items) != 0 {
+		t.Errorf("got %d items, want none kept", len(items))
+	}
+	if stats := logger.(goservice.StatsLogger).Stats(); stats.Rejected != 1 {
+		t.Errorf("got %+v, want the item rejected", stats)
+	}
+}
@@ -0,0 +1,227 @@
+package goservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health statuses reported by the health endpoints.
+const (
+	HEALTH_HEALTHY   = "healthy"
+	HEALTH_DEGRADED  = "degraded"
+	HEALTH_UNHEALTHY = "unhealthy"
+)
+
+// Checker checks one dependency of the service, returning an error if it is unhealthy.
+// It should give up when ctx is done.
+type Checker func(ctx context.Context) error
+
+// HealthCheck is a Checker registered with Health.
+type HealthCheck struct {
+	Name  string
+	Check Checker
+	// Timeout limits how long the check may take. Defaults to 5s.
+	Timeout time.Duration
+	// Critical checks make the service unhealthy when they fail. Other checks only make it
+	// degraded, which still counts as ready.
+	Critical bool
+	// Liveness checks also run for /healthz. Only include checks that a restart would fix.
+	Liveness bool
+}
+
+// HealthResult is the outcome of a single check.
+type HealthResult struct {
+	Status    string    `json:"status"`
+	Critical  bool      `json:"critical"`
+	Duration  float64   `json:"duration_ms"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// HealthReport is the body of the health endpoints.
+type HealthReport struct {
+	Status string                  `json:"status"`
+	Ready  *bool                   `json:"ready,omitempty"`
+	Checks map[string]HealthResult `json:"checks"`
+}
+
+// Health serves liveness and readiness endpoints backed by registered checks. Results
+// are cached, so frequent probes don't overload the dependencies being checked, and each
+// fresh result is logged as availability telemetry if the logger is an AvailabilityLogger.
+type Health struct {
+	logger   IrisLogger
+	cacheFor time.Duration
+	ready    func() bool
+
+	mu     sync.Mutex
+	checks []HealthCheck
+	cache  map[string]HealthResult
+}
+
+// NewHealth creates a Health without checks. Results are reused for cacheFor; pass zero
+// to run the checks on every probe. The logger is optional.
+func NewHealth(logger IrisLogger, cacheFor time.Duration) *Health {
+	return &Health{
+		logger:   logger,
+		cacheFor: cacheFor,
+		cache:    map[string]HealthResult{},
+	}
+}
+
+// Register adds a check.
+func (h *Health) Register(check HealthCheck) {
+	if check.Timeout <= 0 {
+		check.Timeout = 5 * time.Second
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, check)
+}
+
+// SetReadiness makes /readyz report unavailable whenever ready returns false, e.g. while
+// the service is shutting down. Service does this with its own readiness.
+func (h *Health) SetReadiness(ready func() bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = ready
+}
+
+// LivenessHandler serves /healthz, running only the liveness checks.
+func (h *Health) LivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.respond(w, h.Report(r.Context(), true), nil)
+	}
+}
+
+// ReadinessHandler serves /readyz, running every check. It also fails while the service
+// isn't ready, without running the checks.
+func (h *Health) ReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		readyFunc := h.ready
+		h.mu.Unlock()
+		ready := readyFunc == nil || readyFunc()
+		if !ready {
+			h.respond(w, HealthReport{Status: HEALTH_UNHEALTHY, Checks: map[string]HealthResult{}}, &ready)
+			return
+		}
+		h.respond(w, h.Report(r.Context(), false), &ready)
+	}
+}
+
+// Wrap serves /healthz and /readyz, passing every other request to next.
+func (h *Health) Wrap(next http.Handler) http.Handler {
+	liveness := h.LivenessHandler()
+	readiness := h.ReadinessHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			liveness(w, r)
+		case "/readyz":
+			readiness(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (h *Health) respond(w http.ResponseWriter, report HealthReport, ready *bool) {
+	report.Ready = ready
+	status := http.StatusOK
+	if report.Status == HEALTH_UNHEALTHY {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Report runs the checks, or reuses their cached results, and aggregates them. Only
+// liveness checks are included when livenessOnly is set. The checks are not cancelled with
+// ctx, only by their timeout, so that a probe that gives up doesn't cache a failure.
+func (h *Health) Report(ctx context.Context, livenessOnly bool) HealthReport {
+	h.mu.Lock()
+	checks := make([]HealthCheck, 0, len(h.checks))
+	for _, check := range h.checks {
+		if !livenessOnly || check.Liveness {
+			checks = append(checks, check)
+		}
+	}
+	h.mu.Unlock()
+
+	results := make([]HealthResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			results[i] = h.result(check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: HEALTH_HEALTHY, Checks: map[string]HealthResult{}}
+	for i, check := range checks {
+		result := results[i]
+		report.Checks[check.Name] = result
+		if result.Status == HEALTH_HEALTHY {
+			continue
+		}
+		if check.Critical {
+			report.Status = HEALTH_UNHEALTHY
+		} else if report.Status == HEALTH_HEALTHY {
+			report.Status = HEALTH_DEGRADED
+		}
+	}
+	return report
+}
+
+// result returns the cached result of the check if it is recent enough, and runs it
+// otherwise.
+func (h *Health) result(check HealthCheck) HealthResult {
+	now := currentClock.Now()
+	h.mu.Lock()
+	cached, ok := h.cache[check.Name]
+	h.mu.Unlock()
+	if ok && now.Sub(cached.CheckedAt) < h.cacheFor {
+		return cached
+	}
+
+	checkCtx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- check.Check(checkCtx)
+	}()
+	var err error
+	select {
+	case err = <-errs:
+	case <-checkCtx.Done():
+		err = Timeout("health_check", "health check "+check.Name+" timed out after "+check.Timeout.String(), nil)
+	}
+	duration := currentClock.Since(now)
+
+	result := HealthResult{
+		Status:    HEALTH_HEALTHY,
+		Critical:  check.Critical,
+		Duration:  float64(duration) / float64(time.Millisecond),
+		CheckedAt: now,
+	}
+	message := ""
+	if err != nil {
+		result.Status = HEALTH_UNHEALTHY
+		result.Error = err.Error()
+		message = err.Error()
+	}
+	if logger, ok := h.logger.(AvailabilityLogger); ok {
+		logger.Availability(check.Name, duration, err == nil, message, IrisLogContext{OperationName: "health"})
+	}
+	h.mu.Lock()
+	h.cache[check.Name] = result
+	h.mu.Unlock()
+	return result
+}
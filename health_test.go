@@ -0,0 +1,140 @@
+package goservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthReport(t *testing.T) {
+	failing := func(ctx context.Context) error { return errors.New("connection refused") }
+	passing := func(ctx context.Context) error { return nil }
+	tests := []struct {
+		name         string
+		checks       []HealthCheck
+		livenessOnly bool
+		want         string
+	}{
+		{"no checks", nil, false, HEALTH_HEALTHY},
+		{"passing", []HealthCheck{{Name: "db", Check: passing, Critical: true}}, false, HEALTH_HEALTHY},
+		{"critical failing", []HealthCheck{{Name: "db", Check: failing, Critical: true}, {Name: "cache", Check: passing}}, false, HEALTH_UNHEALTHY},
+		{"other failing", []HealthCheck{{Name: "db", Check: passing, Critical: true}, {Name: "cache", Check: failing}}, false, HEALTH_DEGRADED},
+		{"readiness check left out of liveness", []HealthCheck{{Name: "db", Check: failing, Critical: true}}, true, HEALTH_HEALTHY},
+		{"liveness check", []HealthCheck{{Name: "disk", Check: failing, Critical: true, Liveness: true}}, true, HEALTH_UNHEALTHY},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			health := NewHealth(nil, 0)
+			for _, check := range test.checks {
+				health.Register(check)
+			}
+			report := health.Report(context.Background(), test.livenessOnly)
+			if report.Status != test.want {
+				t.Errorf("got %s, want %s: %+v", report.Status, test.want, report.Checks)
+			}
+		})
+	}
+}
+
+func TestHealthCachesResults(t *testing.T) {
+	logger := &recordingLogger{}
+	health := NewHealth(logger, time.Hour)
+	var calls int32
+	health.Register(HealthCheck{Name: "db", Check: func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}})
+
+	health.Report(context.Background(), false)
+	health.Report(context.Background(), false)
+	if calls != 1 {
+		t.Errorf("the check ran %d times within the cache period, want once", calls)
+	}
+	if availability := logger.byKind("availability"); len(availability) != 1 || !availability[0].Success || availability[0].Name != "db" {
+		t.Errorf("logged %+v, want one successful result", availability)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	logger := &recordingLogger{}
+	health := NewHealth(logger, 0)
+	health.Register(HealthCheck{Name: "db", Critical: true, Timeout: 10 * time.Millisecond, Check: func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}})
+
+	report := health.Report(context.Background(), false)
+	if report.Status != HEALTH_UNHEALTHY || !strings.Contains(report.Checks["db"].Error, "timed out after 10ms") {
+		t.Errorf("got %+v, want the check timed out", report)
+	}
+	if availability := logger.byKind("availability"); len(availability) != 1 || availability[0].Success {
+		t.Errorf("logged %+v, want the failure", availability)
+	}
+}
+
+func TestHealthIgnoresCancelledProbes(t *testing.T) {
+	logger := &recordingLogger{}
+	health := NewHealth(logger, time.Hour)
+	health.Register(HealthCheck{Name: "db", Critical: true, Check: func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+			return nil
+		}
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report := health.Report(ctx, false); report.Status != HEALTH_HEALTHY {
+		t.Errorf("got %+v for a cancelled probe, want the check to complete", report)
+	}
+
+	recorder := httptest.NewRecorder()
+	health.ReadinessHandler()(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("got /readyz %d after a cancelled probe, want 200: %s", recorder.Code, recorder.Body.String())
+	}
+	for _, availability := range logger.byKind("availability") {
+		if !availability.Success {
+			t.Errorf("logged a failure for a cancelled probe: %+v", availability)
+		}
+	}
+}
+
+func TestHealthReadiness(t *testing.T) {
+	health := NewHealth(nil, 0)
+	var checked int32
+	health.Register(HealthCheck{Name: "db", Check: func(ctx context.Context) error {
+		atomic.AddInt32(&checked, 1)
+		return nil
+	}})
+	ready := false
+	health.SetReadiness(func() bool { return ready })
+	handler := health.Wrap(http.NotFoundHandler())
+
+	serve := func(path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder.Code
+	}
+	if status := serve("/readyz"); status != http.StatusServiceUnavailable || checked != 0 {
+		t.Errorf("got %d with %d checks run while not ready, want 503 without checks", status, checked)
+	}
+	if status := serve("/healthz"); status != http.StatusOK {
+		t.Errorf("got /healthz %d while not ready, want 200", status)
+	}
+	ready = true
+	if status := serve("/readyz"); status != http.StatusOK || checked != 1 {
+		t.Errorf("got %d with %d checks run once ready, want 200 with the check", status, checked)
+	}
+	if status := serve("/other"); status != http.StatusNotFound {
+		t.Errorf("got %d for another path, want it passed on", status)
+	}
+}
@@ -1,10 +1,18 @@
 package goservice
 
 import (
+	ctxpkg "context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"io"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,13 +24,25 @@ var (
 		// ERROR_UNSUPPORTED_MEDIA_TYPE: http.StatusBadRequest,          // 400
 		ERROR_FORBIDDEN:           http.StatusForbidden,           // 403
 		ERROR_INTERNAL_SERVICE:    http.StatusInternalServerError, // 500
+		ERROR_METHOD_NOT_ALLOWED:  http.StatusMethodNotAllowed,    // 405
 		ERROR_NOT_FOUND:           http.StatusNotFound,            // 404
 		ERROR_PRECONDITION_FAILED: http.StatusPreconditionFailed,  // 412
 		ERROR_TIMEOUT:             http.StatusGatewayTimeout,      // 504
+		ERROR_TOO_MANY_REQUESTS:   http.StatusTooManyRequests,     // 429
 		ERROR_UNAUTHORIZED:        http.StatusUnauthorized,        // 401
+		ERROR_UNAVAILABLE:         http.StatusServiceUnavailable,  // 503
 	}
 )
 
+// inFlightRequests counts the requests being handled by HttpRequestHandler.
+var inFlightRequests int64
+
+// InFlightRequests returns the number of requests currently being handled by
+// HttpRequestHandler, across all handlers.
+func InFlightRequests() int64 {
+	return atomic.LoadInt64(&inFlightRequests)
+}
+
 func ErrorCodeToStatusCode(errorCode string) int {
 	statusCode, ok := mapErrorStatusToHttp[errorCode]
 	if ok {
@@ -33,15 +53,90 @@ func ErrorCodeToStatusCode(errorCode string) int {
 
 type HttpRequestHandlerFunc func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError
 
-func HttpRequestHandler(h HttpRequestHandlerFunc, logger IrisLogger) http.HandlerFunc {
+// HandlerOption configures HttpRequestHandler.
+type HandlerOption func(options *handlerOptions)
+
+type handlerOptions struct {
+	catalog    *MessageCatalog
+	production bool
+	metrics    *MetricsRegistry
+}
+
+// WithMessageCatalog makes error responses use the catalog's messages, in the locale
+// chosen from the request's Accept-Language header. Responses using catalog messages have
+// a Content-Language header with the locales of the messages.
+func WithMessageCatalog(catalog *MessageCatalog) HandlerOption {
+	return func(options *handlerOptions) {
+		options.catalog = catalog
+	}
+}
+
+// WithProductionMode stops the internal message and params of server errors (5xx) from
+// being sent to clients. Errors with a catalog or public message still show that message.
+func WithProductionMode() HandlerOption {
+	return func(options *handlerOptions) {
+		options.production = true
+	}
+}
+
+func newHandlerOptions(opts []HandlerOption) *handlerOptions {
+	options := &handlerOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// publicError returns a copy of the error as it should be sent to the client. The locales
+// of the catalog messages used in it are added to languages.
+func (options *handlerOptions) publicError(err *IrisError, locale string, languages *[]string) *IrisError {
+	public := *err
+	message, language, ok := "", "", false
+	if options.catalog != nil {
+		message, language, ok = options.catalog.message(locale, err)
+	}
+	if ok && !containsString(*languages, language) {
+		*languages = append(*languages, language)
+	}
+	if !ok && err.PublicMessage != "" {
+		message, ok = err.PublicMessage, true
+	}
+	if options.production && ErrorCodeToStatusCode(err.TypeCode) >= 500 {
+		public.Params = map[string]string{}
+		if !ok {
+			message, ok = genericPublicMessage, true
+		}
+	}
+	if ok {
+		public.Message = message
+	}
+	if len(err.Errors) > 0 {
+		public.Errors = make([]ErrorListItem, len(err.Errors))
+		for i, item := range err.Errors {
+			public.Errors[i] = ErrorListItem{Field: item.Field, IrisError: options.publicError(item.IrisError, locale, languages)}
+		}
+	}
+	return &public
+}
+
+// HttpRequestHandler adapts h to an http.HandlerFunc, logging each request and writing
+// any returned error as a JSON response with the matching status code.
+func HttpRequestHandler(h HttpRequestHandlerFunc, logger IrisLogger, opts ...HandlerOption) http.HandlerFunc {
+	options := newHandlerOptions(opts)
 	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inFlightRequests, 1)
+		defer atomic.AddInt64(&inFlightRequests, -1)
 		context := IrisLogContext{
 			CorrelationId: uuid.New().String(),
-			UserId:        "abc123",
+			SpanId:        uuid.New().String(),
+			Properties:    map[string]string{},
 		}
+		info := &requestInfo{}
+		r = r.WithContext(withRequestInfo(WithLogger(WithLogContext(r.Context(), context), logger), info))
 		start := time.Now()
-		err := h(w, r, context)
+		err := callRecovering(h, w, r, context, logger)
 		duration := time.Since(start)
+		context.UserId, context.OperationName = info.get()
 		responseCode := 200
 		if err != nil {
 			responseCode = ErrorCodeToStatusCode(err.TypeCode)
@@ -55,11 +150,132 @@ func HttpRequestHandler(h HttpRequestHandlerFunc, logger IrisLogger) http.Handle
 		url := scheme + "://" + r.Host + r.RequestURI
 		responseCodeString := strconv.Itoa(responseCode)
 		logger.Request(r.Method, url, duration, responseCodeString, clientAddress, context)
+		options.recordRequest(context.OperationName, r.Method, responseCode, duration.Seconds(), err)
 
 		if err != nil {
+			locale := ""
+			if options.catalog != nil {
+				locale = options.catalog.Locale(r.Header.Get("Accept-Language"))
+			}
+			var languages []string
+			public := options.publicError(err, locale, &languages)
+			if len(languages) > 0 {
+				w.Header().Set("Content-Language", strings.Join(languages, ", "))
+			}
+			if retryAfter, ok := retryAfterHint(err); ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			}
+			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(responseCode)
-			json.NewEncoder(w).Encode(err)
+			json.NewEncoder(w).Encode(public)
+			return
+		}
+	}
+}
+
+type requestInfoKey struct{}
+
+// requestInfo is shared through the request context, so that middleware can fill in
+// details of the request telemetry that are only known once the request is handled.
+type requestInfo struct {
+	mu            sync.Mutex
+	userId        string
+	operationName string
+}
+
+func withRequestInfo(ctx ctxpkg.Context, info *requestInfo) ctxpkg.Context {
+	return ctxpkg.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func (info *requestInfo) get() (string, string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.userId, info.operationName
+}
+
+func updateRequestInfo(r *http.Request, update func(info *requestInfo)) {
+	info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	update(info)
+}
+
+// SetRequestUserId sets the user id that HttpRequestHandler logs the request with.
+// Authentication middleware calls this, as changes to the IrisLogContext it is given
+// only reach the handlers it calls.
+func SetRequestUserId(r *http.Request, userId string) {
+	updateRequestInfo(r, func(info *requestInfo) {
+		info.userId = userId
+	})
+}
+
+// SetRequestOperationName sets the operation name that HttpRequestHandler logs the
+// request with. Routers call this with the matched route.
+func SetRequestOperationName(r *http.Request, operationName string) {
+	updateRequestInfo(r, func(info *requestInfo) {
+		info.operationName = operationName
+	})
+}
+
+// callRecovering calls h, turning a panic into an internal service error so that the
+// request is still logged and answered. The panic value is logged, and the client gets a
+// generic message. http.ErrAbortHandler is passed on, as it aborts the response on purpose.
+func callRecovering(h HttpRequestHandlerFunc, w http.ResponseWriter, r *http.Request, context IrisLogContext, logger IrisLogger) (err *IrisError) {
+	defer func() {
+		p := recover()
+		if p == nil {
 			return
 		}
+		if p == http.ErrAbortHandler {
+			panic(p)
+		}
+		logger.Error("handler_panic", p, nil, context)
+		err = InternalService("panic", fmt.Sprint(p), nil)
+		err.PublicMessage = genericPublicMessage
+	}()
+	return h(w, r, context)
+}
+
+// DecodeJSON decodes the JSON body of the request into v, then validates it with
+// `Validate`. A body that cannot be decoded is a bad request, as is one that breaks the
+// validation rules, in which case the error lists every invalid field.
+func DecodeJSON(r *http.Request, v interface{}) *IrisError {
+	if err := decodeJSONBody(r.Body, v, false, false); err != nil {
+		return err
+	}
+	return Validate(v)
+}
+
+// decodeJSONBody decodes a single JSON value from body into v. When strict is set,
+// fields that v doesn't have and data after the value are rejected. When allowEmpty is
+// set, an empty body leaves v as it is.
+func decodeJSONBody(body io.Reader, v interface{}, strict bool, allowEmpty bool) *IrisError {
+	decoder := json.NewDecoder(body)
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	if err == io.EOF && allowEmpty {
+		return nil
+	}
+	if err == nil && strict {
+		if _, tokenErr := decoder.Token(); tokenErr != io.EOF {
+			err = errors.New("unexpected data after the JSON value")
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return BadRequest("body_too_large", "request body is too large", map[string]string{
+			"limit": strconv.FormatInt(tooLarge.Limit, 10),
+		})
 	}
+	return BadRequest("invalid_json", "request body is not valid JSON", map[string]string{
+		"error": err.Error(),
+	})
 }
@@ -0,0 +1,127 @@
+package goservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttpRequestHandlerRecoversPanics(t *testing.T) {
+	logger := &recordingLogger{}
+	handler := HttpRequestHandler(func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+		panic("secret connection string")
+	}, logger)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/", nil))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", recorder.Code)
+	}
+	if strings.Contains(recorder.Body.String(), "secret") {
+		t.Errorf("the panic value was sent to the client: %s", recorder.Body.String())
+	}
+	body := IrisError{}
+	if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Message != genericPublicMessage {
+		t.Errorf("got message %q, want the generic message", body.Message)
+	}
+	if errors := logger.byKind("error"); len(errors) != 1 || errors[0].Name != "handler_panic" {
+		t.Errorf("got logged errors %v, want the panic", errors)
+	}
+	if requests := logger.byKind("request"); len(requests) != 1 || requests[0].ResponseCode != "500" {
+		t.Errorf("got logged requests %v, want one with 500", requests)
+	}
+}
+
+// serveError runs a handler returning err, and returns the response and its decoded body.
+func serveError(t *testing.T, err *IrisError, acceptLanguage string, opts ...HandlerOption) (*httptest.ResponseRecorder, IrisError) {
+	handler := HttpRequestHandler(func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+		return err
+	}, &recordingLogger{}, opts...)
+	request := httptest.NewRequest("GET", "/", nil)
+	if acceptLanguage != "" {
+		request.Header.Set("Accept-Language", acceptLanguage)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	body := IrisError{}
+	if decodeErr := json.NewDecoder(recorder.Body).Decode(&body); decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	return recorder, body
+}
+
+func TestHttpRequestHandlerTranslatesErrors(t *testing.T) {
+	catalog := newTestCatalog()
+	err := BadRequest("missing", "name missing from body", map[string]string{"field": "name"})
+
+	recorder, body := serveError(t, err, "fr-CA, en;q=0.5", WithMessageCatalog(catalog))
+	if body.Message != "name est obligatoire" {
+		t.Errorf("got message %q, want the French one", body.Message)
+	}
+	if language := recorder.Header().Get("Content-Language"); language != "fr" {
+		t.Errorf("got Content-Language %q, want fr", language)
+	}
+
+	recorder, body = serveError(t, Unavailable("db", "connection refused", nil), "fr", WithMessageCatalog(catalog))
+	if body.Message != "connection refused" {
+		t.Errorf("got message %q, want the error's own", body.Message)
+	}
+	if language := recorder.Header().Get("Content-Language"); language != "" {
+		t.Errorf("got Content-Language %q without a catalog message", language)
+	}
+}
+
+func TestHttpRequestHandlerTranslatesErrorListItems(t *testing.T) {
+	list := ErrorList{}
+	list.Add("name", BadRequest("missing", "", map[string]string{"field": "name"}))
+	recorder, body := serveError(t, list.Err(), "fr", WithMessageCatalog(newTestCatalog()))
+	if len(body.Errors) != 1 || body.Errors[0].Message != "name est obligatoire" {
+		t.Errorf("got items %+v, want the French message", body.Errors)
+	}
+	// The list itself only has a message in the default locale.
+	if body.Message != "The request is invalid" {
+		t.Errorf("got message %q, want the English one", body.Message)
+	}
+	if language := recorder.Header().Get("Content-Language"); language != "en, fr" {
+		t.Errorf("got Content-Language %q, want en, fr", language)
+	}
+}
+
+func TestHttpRequestHandlerProductionMode(t *testing.T) {
+	secret := map[string]string{"dsn": "postgres://secret"}
+	tests := []struct {
+		name        string
+		err         *IrisError
+		wantMessage string
+		wantParams  bool
+	}{
+		{"server error", InternalService("query", "query failed on db-3", secret), genericPublicMessage, false},
+		{"server error with public message", Unavailable("db", "db-3 down", secret).WithPublicMessage("Try again later"), "Try again later", false},
+		{"client error", BadRequest("missing", "name is required", map[string]string{"field": "name"}), "name is required", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder, body := serveError(t, test.err, "", WithProductionMode())
+			if body.Message != test.wantMessage {
+				t.Errorf("got message %q, want %q", body.Message, test.wantMessage)
+			}
+			if (len(body.Params) > 0) != test.wantParams {
+				t.Errorf("got params %v", body.Params)
+			}
+			if strings.Contains(recorder.Body.String(), "secret") || strings.Contains(recorder.Body.String(), "db-3") {
+				t.Errorf("internal details were sent: %s", recorder.Body.String())
+			}
+		})
+	}
+
+	_, body := serveError(t, InternalService("query", "query failed on db-3", nil), "")
+	if body.Message != "query failed on db-3" {
+		t.Errorf("got message %q outside production mode, want the internal one", body.Message)
+	}
+}
@@ -0,0 +1,68 @@
+package goservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// defaultMaxBodyBytes is the request body limit used when JSONHandlerSettings has none.
+const defaultMaxBodyBytes = 1 << 20
+
+// JSONHandlerSettings configures JSONHandler. Zero fields are replaced by the defaults
+// noted on them.
+type JSONHandlerSettings struct {
+	// MaxBodyBytes limits the size of the request body. Defaults to 1MB.
+	MaxBodyBytes int64
+	// Status is the status code of successful responses. Defaults to 200. No body is
+	// written for 204 No Content.
+	Status int
+}
+
+// JSONHandler adapts a typed function to an HttpRequestHandlerFunc. The request body is
+// decoded into Req and checked with `Validate`; bodies that are too large, have fields Req
+// doesn't, or break a validation rule are rejected as bad requests before fn is called.
+// An empty body leaves Req as its zero value, which suits requests such as GETs.
+//
+// fn gets the request context, which carries the log context and any JWT claims. Its
+// response is encoded as JSON, and a response that can't be encoded is reported as a
+// `bad_response` error.
+func JSONHandler[Req any, Resp any](settings JSONHandlerSettings, fn func(ctx context.Context, req Req) (Resp, *IrisError)) HttpRequestHandlerFunc {
+	if settings.MaxBodyBytes <= 0 {
+		settings.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if settings.Status == 0 {
+		settings.Status = http.StatusOK
+	}
+	return func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+		var req Req
+		if r.Body != nil && r.Body != http.NoBody {
+			body := http.MaxBytesReader(w, r.Body, settings.MaxBodyBytes)
+			if err := decodeJSONBody(body, &req, true, true); err != nil {
+				return err
+			}
+		}
+		if err := Validate(req); err != nil {
+			return err
+		}
+
+		resp, err := fn(r.Context(), req)
+		if err != nil {
+			return err
+		}
+		if settings.Status == http.StatusNoContent {
+			w.WriteHeader(settings.Status)
+			return nil
+		}
+		bytes, marshalErr := json.Marshal(resp)
+		if marshalErr != nil {
+			return BadResponse("encoding_failed", "response could not be encoded as JSON", map[string]string{
+				"error": marshalErr.Error(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(settings.Status)
+		w.Write(append(bytes, '\n'))
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+package goservice
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type createUserRequest struct {
+	Name string `json:"name" validate:"required"`
+	Age  int    `json:"age" validate:"min=18"`
+}
+
+type createUserResponse struct {
+	Id string `json:"id"`
+}
+
+// chunkedBody is a request body of unknown length, as a chunked request has.
+type chunkedBody struct {
+	io.Reader
+}
+
+func (chunkedBody) Close() error { return nil }
+
+func serveJSON(handler HttpRequestHandlerFunc, body io.Reader) (*httptest.ResponseRecorder, *IrisError) {
+	request := httptest.NewRequest("POST", "/users", body)
+	recorder := httptest.NewRecorder()
+	return recorder, handler(recorder, request, IrisLogContext{})
+}
+
+func TestJSONHandler(t *testing.T) {
+	var got createUserRequest
+	handler := JSONHandler(JSONHandlerSettings{Status: http.StatusCreated, MaxBodyBytes: 64}, func(ctx context.Context, req createUserRequest) (createUserResponse, *IrisError) {
+		got = req
+		return createUserResponse{Id: "1"}, nil
+	})
+
+	recorder, err := serveJSON(handler, strings.NewReader(`{"name": "Ada", "age": 36}`))
+	if err != nil {
+		t.Fatalf("got %v", err)
+	}
+	if got.Name != "Ada" || got.Age != 36 {
+		t.Errorf("decoded %+v", got)
+	}
+	if recorder.Code != http.StatusCreated || recorder.Body.String() != "{\"id\":\"1\"}\n" {
+		t.Errorf("got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+		t.Errorf("got Content-Type %q", contentType)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"unknown field", `{"name": "Ada", "age": 36, "admin": true}`, "bad_request.invalid_json"},
+		{"second value", `{"name": "Ada", "age": 36} {}`, "bad_request.invalid_json"},
+		{"trailing brace", `{"name": "Ada", "age": 36}}`, "bad_request.invalid_json"},
+		{"trailing garbage", `{"name": "Ada", "age": 36} x`, "bad_request.invalid_json"},
+		{"not json", `name=Ada`, "bad_request.invalid_json"},
+		{"too large", `{"name": "` + strings.Repeat("a", 100) + `", "age": 36}`, "bad_request.body_too_large"},
+		{"invalid fields", `{"age": 12}`, "bad_request.validation_failed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := serveJSON(handler, strings.NewReader(test.body)); err == nil || err.Code != test.want {
+				t.Errorf("got %v, want %s", err, test.want)
+			}
+		})
+	}
+
+	_, err = serveJSON(handler, strings.NewReader(`{"age": 12}`))
+	if len(err.Errors) != 2 || err.Errors[0].Field != "/name" || err.Errors[1].Field != "/age" {
+		t.Errorf("got items %+v, want one per invalid field", err.Errors)
+	}
+	if _, err := serveJSON(handler, strings.NewReader(`{"name": "Ada", "age": 36}`+"\n")); err != nil {
+		t.Errorf("a trailing newline was rejected: %v", err)
+	}
+}
+
+func TestJSONHandlerEmptyBody(t *testing.T) {
+	called := false
+	handler := JSONHandler(JSONHandlerSettings{}, func(ctx context.Context, req struct{ Page int }) (struct{}, *IrisError) {
+		called = true
+		return struct{}{}, nil
+	})
+	bodies := map[string]io.Reader{
+		"no body":      nil,
+		"empty":        strings.NewReader(""),
+		"chunked":      chunkedBody{strings.NewReader("")},
+		"only spacing": chunkedBody{strings.NewReader(" \n")},
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			called = false
+			request := httptest.NewRequest("GET", "/users", body)
+			if _, ok := body.(chunkedBody); ok {
+				request.ContentLength = -1
+			}
+			if err := handler(httptest.NewRecorder(), request, IrisLogContext{}); err != nil || !called {
+				t.Errorf("got %v, want the empty body accepted", err)
+			}
+		})
+	}
+
+	required := JSONHandler(JSONHandlerSettings{}, func(ctx context.Context, req createUserRequest) (struct{}, *IrisError) {
+		return struct{}{}, nil
+	})
+	if _, err := serveJSON(required, nil); err == nil || err.Code != "bad_request.validation_failed" {
+		t.Errorf("got %v, want an empty body to still be validated", err)
+	}
+}
+
+func TestJSONHandlerResponses(t *testing.T) {
+	noContent := JSONHandler(JSONHandlerSettings{Status: http.StatusNoContent}, func(ctx context.Context, req struct{}) (createUserResponse, *IrisError) {
+		return createUserResponse{Id: "1"}, nil
+	})
+	recorder, err := serveJSON(noContent, nil)
+	if err != nil || recorder.Code != http.StatusNoContent || recorder.Body.Len() != 0 {
+		t.Errorf("got %v, %d %q, want 204 without a body", err, recorder.Code, recorder.Body.String())
+	}
+
+	unencodable := JSONHandler(JSONHandlerSettings{}, func(ctx context.Context, req struct{}) (func(), *IrisError) {
+		return func() {}, nil
+	})
+	if _, err := serveJSON(unencodable, nil); err == nil || err.Code != "bad_response.encoding_failed" {
+		t.Errorf("got %v, want bad_response.encoding_failed", err)
+	}
+
+	failing := JSONHandler(JSONHandlerSettings{}, func(ctx context.Context, req struct{}) (struct{}, *IrisError) {
+		return struct{}{}, NotFound("user", "no such user", nil)
+	})
+	recorder, err = serveJSON(failing, nil)
+	if err == nil || err.Code != "not_found.user" || recorder.Body.Len() != 0 {
+		t.Errorf("got %v, %q, want the error returned unwritten", err, recorder.Body.String())
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	var req createUserRequest
+	request := httptest.NewRequest("POST", "/users", strings.NewReader(`{"name": "Ada", "age": 36, "admin": true}`))
+	if err := DecodeJSON(request, &req); err != nil || req.Name != "Ada" {
+		t.Errorf("got %v, want unknown fields ignored", err)
+	}
+
+	request = httptest.NewRequest("POST", "/users", strings.NewReader(""))
+	if err := DecodeJSON(request, &req); err == nil || err.Code != "bad_request.invalid_json" {
+		t.Errorf("got %v, want an empty body rejected", err)
+	}
+}
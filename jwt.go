@@ -0,0 +1,304 @@
+package goservice
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Supported JWT signing algorithms.
+const (
+	JWT_HS256 = "HS256"
+	JWT_RS256 = "RS256"
+	JWT_ES256 = "ES256"
+)
+
+// JWTKey is a key that tokens may be signed with. Key is a []byte for HS256, an
+// *rsa.PublicKey for RS256 and an *ecdsa.PublicKey on the P-256 curve for ES256.
+// When both the key and a token have an ID, the token is only checked against the key if
+// its `kid` header matches.
+type JWTKey struct {
+	ID        string
+	Algorithm string
+	Key       interface{}
+}
+
+// JWTClaims are the claims of a verified token.
+type JWTClaims map[string]interface{}
+
+// String returns the claim if it is a string, or an empty string otherwise.
+func (c JWTClaims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// Strings returns the claim as a list, accepting either a single string, a list of
+// strings, or a space separated string as used by the `scope` claim.
+func (c JWTClaims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// JWTSettings configures JWTAuth.
+type JWTSettings struct {
+	// Keys are the keys tokens may be signed with. See LoadJWKS to read them from a file.
+	Keys []JWTKey
+	// Issuer is the required `iss` claim. Not checked when empty.
+	Issuer string
+	// Audience must be one of the token's `aud` values. Not checked when empty.
+	Audience string
+	// UserIdClaim is the claim used as the user id in telemetry. Defaults to `sub`.
+	UserIdClaim string
+	// Leeway allows for clock skew when checking `exp` and `nbf`.
+	Leeway time.Duration
+	// AllowNoExpiry accepts tokens without an `exp` claim, which are otherwise rejected as
+	// they would be valid forever.
+	AllowNoExpiry bool
+}
+
+type jwtClaimsKey struct{}
+
+// ClaimsFrom returns the claims JWTAuth stored in the request context.
+func ClaimsFrom(ctx context.Context) (JWTClaims, bool) {
+	claims, ok := ctx.Value(jwtClaimsKey{}).(JWTClaims)
+	return claims, ok
+}
+
+// JWTAuth returns a middleware that requires a valid bearer token. Missing, malformed,
+// badly signed, expired and unexpiring tokens are rejected as `unauthorized`; tokens that
+// are valid but issued by someone else or for another audience are `forbidden`. Expiry is
+// checked against the package clock.
+//
+// The claims of an accepted token are stored in the request context, see ClaimsFrom, and
+// the user id claim is set on the IrisLogContext and the request telemetry.
+func JWTAuth(settings JWTSettings) Middleware {
+	if settings.UserIdClaim == "" {
+		settings.UserIdClaim = "sub"
+	}
+	return func(next HttpRequestHandlerFunc) HttpRequestHandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, logContext IrisLogContext) *IrisError {
+			header := r.Header.Get("Authorization")
+			if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				return Unauthorized("missing_token", "a bearer token is required", nil)
+			}
+			claims, err := verifyJWT(strings.TrimSpace(header[7:]), settings)
+			if err != nil {
+				if err.TypeCode == ERROR_UNAUTHORIZED {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				}
+				return err
+			}
+			logContext.UserId = claims.String(settings.UserIdClaim)
+			SetRequestUserId(r, logContext.UserId)
+			ctx := context.WithValue(r.Context(), jwtClaimsKey{}, claims)
+			ctx = WithLogContext(ctx, logContext)
+			return next(w, r.WithContext(ctx), logContext)
+		}
+	}
+}
+
+func verifyJWT(token string, settings JWTSettings) (JWTClaims, *IrisError) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, Unauthorized("invalid_token", "token is not a JWT", nil)
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, Unauthorized("invalid_token", "token header is malformed", nil)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, Unauthorized("invalid_token", "token signature is malformed", nil)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range settings.Keys {
+		// The algorithm must match the key, so a token can't pick a weaker way to be checked.
+		if key.Algorithm != header.Algorithm || (key.ID != "" && header.KeyID != "" && key.ID != header.KeyID) {
+			continue
+		}
+		if verifyJWTSignature(key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, Unauthorized("invalid_signature", "token signature is not valid", map[string]string{
+			"alg": header.Algorithm,
+			"kid": header.KeyID,
+		})
+	}
+
+	var claims JWTClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, Unauthorized("invalid_token", "token claims are malformed", nil)
+	}
+	now := currentClock.Now()
+	exp, hasExpiry := claims["exp"].(float64)
+	if !hasExpiry && !settings.AllowNoExpiry {
+		return nil, Unauthorized("missing_expiry", "token has no expiry", nil)
+	}
+	if hasExpiry && !now.Before(jwtTime(exp).Add(settings.Leeway)) {
+		return nil, Unauthorized("token_expired", "token has expired", nil)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(settings.Leeway).Before(jwtTime(nbf)) {
+		return nil, Unauthorized("token_not_yet_valid", "token is not valid yet", nil)
+	}
+	if settings.Issuer != "" && claims.String("iss") != settings.Issuer {
+		return nil, Forbidden("invalid_issuer", "token was not issued by a trusted issuer", map[string]string{
+			"iss": claims.String("iss"),
+		})
+	}
+	if settings.Audience != "" && !containsString(claims.Strings("aud"), settings.Audience) {
+		return nil, Forbidden("invalid_audience", "token is not intended for this service", map[string]string{
+			"aud": strings.Join(claims.Strings("aud"), " "),
+		})
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, v)
+}
+
+func jwtTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+func verifyJWTSignature(key JWTKey, signed []byte, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch key.Algorithm {
+	case JWT_HS256:
+		secret, ok := key.Key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case JWT_RS256:
+		publicKey, ok := key.Key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case JWT_ES256:
+		publicKey, ok := key.Key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(publicKey, digest[:], r, s)
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadJWKS reads the keys of a JSON Web Key Set file. RSA keys are used for RS256, P-256
+// EC keys for ES256 and symmetric (`oct`) keys for HS256, unless the key names another
+// algorithm in its `alg` field.
+func LoadJWKS(path string) ([]JWTKey, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			KeyType   string `json:"kty"`
+			KeyID     string `json:"kid"`
+			Algorithm string `json:"alg"`
+			Use       string `json:"use"`
+			N         string `json:"n"`
+			E         string `json:"e"`
+			Curve     string `json:"crv"`
+			X         string `json:"x"`
+			Y         string `json:"y"`
+			K         string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(bytes, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS %s: %v", path, err)
+	}
+	keys := make([]JWTKey, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key := JWTKey{ID: jwk.KeyID, Algorithm: jwk.Algorithm}
+		switch jwk.KeyType {
+		case "RSA":
+			n, nErr := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, eErr := base64.RawURLEncoding.DecodeString(jwk.E)
+			if nErr != nil || eErr != nil {
+				return nil, fmt.Errorf("parsing JWKS %s: invalid RSA key %q", path, jwk.KeyID)
+			}
+			key.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			if key.Algorithm == "" {
+				key.Algorithm = JWT_RS256
+			}
+		case "EC":
+			x, xErr := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, yErr := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if jwk.Curve != "P-256" || xErr != nil || yErr != nil {
+				return nil, fmt.Errorf("parsing JWKS %s: invalid EC key %q", path, jwk.KeyID)
+			}
+			key.Key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if key.Algorithm == "" {
+				key.Algorithm = JWT_ES256
+			}
+		case "oct":
+			k, kErr := base64.RawURLEncoding.DecodeString(jwk.K)
+			if kErr != nil {
+				return nil, fmt.Errorf("parsing JWKS %s: invalid symmetric key %q", path, jwk.KeyID)
+			}
+			key.Key = k
+			if key.Algorithm == "" {
+				key.Algorithm = JWT_HS256
+			}
+		default:
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
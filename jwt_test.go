@@ -0,0 +1,362 @@
+package goservice
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWTKeys are a key pair of each algorithm, generated once for all tests.
+var testJWTKeys = struct {
+	hmac  []byte
+	rsa   *rsa.PrivateKey
+	ecdsa *ecdsa.PrivateKey
+}{
+	hmac:  []byte("a secret of at least thirty-two bytes"),
+	rsa:   mustGenerateRSAKey(),
+	ecdsa: mustGenerateECDSAKey(),
+}
+
+func mustGenerateRSAKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func mustGenerateECDSAKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func encodeJWTPart(v interface{}) string {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// signJWT returns a token with the header and claims, signed with the test key of alg, or
+// with secret for HS256 if it is given.
+func signJWT(header map[string]string, claims map[string]interface{}, secret []byte) string {
+	signed := encodeJWTPart(header) + "." + encodeJWTPart(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch header["alg"] {
+	case JWT_HS256:
+		if secret == nil {
+			secret = testJWTKeys.hmac
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case JWT_RS256:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, testJWTKeys.rsa, crypto.SHA256, digest[:])
+	case JWT_ES256:
+		r, s, _ := ecdsa.Sign(rand.Reader, testJWTKeys.ecdsa, digest[:])
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testJWTSettings() JWTSettings {
+	return JWTSettings{
+		Keys: []JWTKey{
+			{Algorithm: JWT_HS256, Key: testJWTKeys.hmac},
+			{Algorithm: JWT_RS256, Key: &testJWTKeys.rsa.PublicKey},
+			{Algorithm: JWT_ES256, Key: &testJWTKeys.ecdsa.PublicKey},
+		},
+		Issuer:   "https://issuer.example.com",
+		Audience: "billing",
+		Leeway:   time.Minute,
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	clock := useFakeClock(t)
+	now := float64(clock.Now().Unix())
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub": "user-1",
+			"iss": "https://issuer.example.com",
+			"aud": "billing",
+			"exp": now + 3600,
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+	hs256 := map[string]string{"alg": JWT_HS256, "typ": "JWT"}
+	rsaPublicKey, _ := json.Marshal(testJWTKeys.rsa.PublicKey)
+
+	tests := []struct {
+		name     string
+		token    string
+		settings func(settings *JWTSettings)
+		want     string
+	}{
+		{name: "HS256", token: signJWT(hs256, claims(nil), nil)},
+		{name: "RS256", token: signJWT(map[string]string{"alg": JWT_RS256}, claims(nil), nil)},
+		{name: "ES256", token: signJWT(map[string]string{"alg": JWT_ES256}, claims(nil), nil)},
+		{name: "wrong secret", token: signJWT(hs256, claims(nil), []byte("another secret")), want: "unauthorized.invalid_signature"},
+		{name: "tampered claims", token: tamperJWT(signJWT(map[string]string{"alg": JWT_RS256}, claims(nil), nil)), want: "unauthorized.invalid_signature"},
+		{name: "truncated token", token: signJWT(map[string]string{"alg": JWT_ES256}, claims(nil), nil)[:20], want: "unauthorized.invalid_token"},
+		{name: "alg none", token: encodeJWTPart(map[string]string{"alg": "none"}) + "." + encodeJWTPart(claims(nil)) + ".", want: "unauthorized.invalid_signature"},
+		{
+			name:  "HS256 signed with the RSA public key",
+			token: signJWT(hs256, claims(nil), rsaPublicKey),
+			settings: func(settings *JWTSettings) {
+				settings.Keys = []JWTKey{{Algorithm: JWT_RS256, Key: &testJWTKeys.rsa.PublicKey}}
+			},
+			want: "unauthorized.invalid_signature",
+		},
+		{
+			name:  "key of another type than its algorithm",
+			token: signJWT(hs256, claims(nil), nil),
+			settings: func(settings *JWTSettings) {
+				settings.Keys = []JWTKey{{Algorithm: JWT_HS256, Key: &testJWTKeys.rsa.PublicKey}}
+			},
+			want: "unauthorized.invalid_signature",
+		},
+		{name: "not a JWT", token: "abc.def", want: "unauthorized.invalid_token"},
+		{name: "malformed header", token: "!!!." + encodeJWTPart(claims(nil)) + ".", want: "unauthorized.invalid_token"},
+		{name: "expired", token: signJWT(hs256, claims(map[string]interface{}{"exp": now - 120}), nil), want: "unauthorized.token_expired"},
+		{name: "expired within leeway", token: signJWT(hs256, claims(map[string]interface{}{"exp": now - 30}), nil)},
+		{name: "not yet valid", token: signJWT(hs256, claims(map[string]interface{}{"nbf": now + 120}), nil), want: "unauthorized.token_not_yet_valid"},
+		{name: "not yet valid within leeway", token: signJWT(hs256, claims(map[string]interface{}{"nbf": now + 30}), nil)},
+		{name: "no expiry", token: signJWT(hs256, claims(map[string]interface{}{"exp": nil}), nil), want: "unauthorized.missing_expiry"},
+		{
+			name:     "no expiry allowed",
+			token:    signJWT(hs256, claims(map[string]interface{}{"exp": nil}), nil),
+			settings: func(settings *JWTSettings) { settings.AllowNoExpiry = true },
+		},
+		{name: "other issuer", token: signJWT(hs256, claims(map[string]interface{}{"iss": "https://evil.example.com"}), nil), want: "forbidden.invalid_issuer"},
+		{name: "other audience", token: signJWT(hs256, claims(map[string]interface{}{"aud": "shipping"}), nil), want: "forbidden.invalid_audience"},
+		{name: "audience in a list", token: signJWT(hs256, claims(map[string]interface{}{"aud": []string{"shipping", "billing"}}), nil)},
+		{
+			name:     "issuer and audience not checked",
+			token:    signJWT(hs256, claims(map[string]interface{}{"iss": nil, "aud": nil}), nil),
+			settings: func(settings *JWTSettings) { settings.Issuer, settings.Audience = "", "" },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := testJWTSettings()
+			if test.settings != nil {
+				test.settings(&settings)
+			}
+			claims, err := verifyJWT(test.token, settings)
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("got %v, want the token accepted", err)
+				}
+				if claims.String("sub") != "user-1" {
+					t.Errorf("got claims %v", claims)
+				}
+				return
+			}
+			if err == nil || err.Code != test.want {
+				t.Errorf("got %v, want %s", err, test.want)
+			}
+		})
+	}
+}
+
+// tamperJWT replaces the subject of a token without signing it again.
+func tamperJWT(token string) string {
+	parts := strings.Split(token, ".")
+	var claims map[string]interface{}
+	decodeJWTPart(parts[1], &claims)
+	claims["sub"] = "admin"
+	return parts[0] + "." + encodeJWTPart(claims) + "." + parts[2]
+}
+
+func TestVerifyJWTSelectsKeysById(t *testing.T) {
+	useFakeClock(t)
+	claims := map[string]interface{}{"sub": "user-1", "exp": float64(currentClock.Now().Add(time.Hour).Unix())}
+	first, second := []byte("the first secret"), []byte("the second secret")
+	settings := JWTSettings{Keys: []JWTKey{
+		{ID: "first", Algorithm: JWT_HS256, Key: first},
+		{ID: "second", Algorithm: JWT_HS256, Key: second},
+	}}
+
+	tests := []struct {
+		name   string
+		kid    string
+		secret []byte
+		valid  bool
+	}{
+		{"matching kid", "second", second, true},
+		{"kid of another key", "first", second, false},
+		{"unknown kid", "third", second, false},
+		{"no kid", "", second, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := map[string]string{"alg": JWT_HS256}
+			if test.kid != "" {
+				header["kid"] = test.kid
+			}
+			_, err := verifyJWT(signJWT(header, claims, test.secret), settings)
+			if (err == nil) != test.valid {
+				t.Errorf("got %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	useFakeClock(t)
+	settings := testJWTSettings()
+	var gotClaims JWTClaims
+	var gotContext IrisLogContext
+	handler := JWTAuth(settings)(func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+		gotClaims, _ = ClaimsFrom(r.Context())
+		gotContext = context
+		return nil
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          string
+		challenge     string
+	}{
+		{"no token", "", "unauthorized.missing_token", "Bearer"},
+		{"other scheme", "Basic dXNlcjpwYXNz", "unauthorized.missing_token", "Bearer"},
+		{"invalid token", "Bearer abc", "unauthorized.invalid_token", `Bearer error="invalid_token"`},
+		{"other audience", "Bearer " + signJWT(map[string]string{"alg": JWT_HS256}, map[string]interface{}{
+			"sub": "user-1",
+			"iss": settings.Issuer,
+			"aud": "shipping",
+			"exp": float64(currentClock.Now().Add(time.Hour).Unix()),
+		}, nil), "forbidden.invalid_audience", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			err := handler(recorder, request, IrisLogContext{})
+			if err == nil || err.Code != test.want {
+				t.Errorf("got %v, want %s", err, test.want)
+			}
+			if challenge := recorder.Header().Get("WWW-Authenticate"); challenge != test.challenge {
+				t.Errorf("got WWW-Authenticate %q, want %q", challenge, test.challenge)
+			}
+		})
+	}
+
+	token := signJWT(map[string]string{"alg": JWT_ES256}, map[string]interface{}{
+		"sub": "user-1",
+		"iss": settings.Issuer,
+		"aud": settings.Audience,
+		"exp": float64(currentClock.Now().Add(time.Hour).Unix()),
+	}, nil)
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "bearer "+token)
+	if err := handler(httptest.NewRecorder(), request, IrisLogContext{}); err != nil {
+		t.Fatalf("got %v, want the token accepted", err)
+	}
+	if gotClaims.String("sub") != "user-1" || gotContext.UserId != "user-1" {
+		t.Errorf("got claims %v and user id %q, want user-1", gotClaims, gotContext.UserId)
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	useFakeClock(t)
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	set := map[string]interface{}{"keys": []map[string]string{
+		{
+			"kty": "RSA",
+			"kid": "rsa",
+			"use": "sig",
+			"n":   encode(testJWTKeys.rsa.N.Bytes()),
+			"e":   encode(big.NewInt(int64(testJWTKeys.rsa.E)).Bytes()),
+		},
+		{
+			"kty": "EC",
+			"kid": "ec",
+			"crv": "P-256",
+			"x":   encode(testJWTKeys.ecdsa.X.FillBytes(make([]byte, 32))),
+			"y":   encode(testJWTKeys.ecdsa.Y.FillBytes(make([]byte, 32))),
+		},
+		{"kty": "oct", "kid": "hmac", "k": encode(testJWTKeys.hmac)},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "OKP", "kid": "ed25519", "crv": "Ed25519", "x": "AAAA"},
+	}}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	bytes, _ := json.Marshal(set)
+	if err := os.WriteFile(path, bytes, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("got %d keys, want the 3 signing keys", len(keys))
+	}
+	claims := map[string]interface{}{"sub": "user-1", "exp": float64(currentClock.Now().Add(time.Hour).Unix())}
+	for _, header := range []map[string]string{
+		{"alg": JWT_RS256, "kid": "rsa"},
+		{"alg": JWT_ES256, "kid": "ec"},
+		{"alg": JWT_HS256, "kid": "hmac"},
+	} {
+		if _, err := verifyJWT(signJWT(header, claims, nil), JWTSettings{Keys: keys}); err != nil {
+			t.Errorf("token signed with %s was rejected: %v", header["kid"], err)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"not json":      "{",
+		"bad RSA key":   `{"keys":[{"kty":"RSA","n":"!","e":"AQAB"}]}`,
+		"bad EC curve":  `{"keys":[{"kty":"EC","crv":"P-384","x":"AA","y":"AA"}]}`,
+		"bad oct value": `{"keys":[{"kty":"oct","k":"!"}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		os.WriteFile(path, []byte(content), 0o644)
+		if _, err := LoadJWKS(path); err == nil {
+			t.Errorf("%s: LoadJWKS accepted the file", name)
+		}
+	}
+	if _, err := LoadJWKS(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadJWKS accepted a missing file")
+	}
+}
+
+func TestClaimsFromWithoutClaims(t *testing.T) {
+	if _, ok := ClaimsFrom(context.Background()); ok {
+		t.Error("ClaimsFrom found claims in an empty context")
+	}
+}
@@ -1,11 +1,19 @@
 package goservice
 
 import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
 	"github.com/microsoft/ApplicationInsights-Go/appinsights"
 	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+	"strconv"
 	"time"
 )
 
+// IrisLogger is what telemetry is logged through. Further capabilities, such as
+// DependencyLogger, are interfaces of their own, so that adding one doesn't break existing
+// implementations. The loggers of this package implement them, and callers check for them
+// with a type assertion.
 type IrisLogger interface {
 	// Log a numeric value that is not specified with a specific event.
 	// Typically used to send regular reports of performance indicators.
@@ -36,16 +44,116 @@ type IrisLogger interface {
 	// Log an availability test result with the specified test name,
 	// duration, and success status.
 	// TrackAvailability(name string, duration time.Duration, success bool)
+}
+
+// MetricSummaryLogger is implemented by loggers that can log metrics aggregated in process,
+// as a MetricsRegistry does.
+type MetricSummaryLogger interface {
+	// Log a summary of many values of a metric, aggregated in process.
+	MetricSummary(name string, summary MetricSummary, context IrisLogContext)
+}
+
+// DependencyLogger is implemented by loggers that can log calls to dependencies.
+type DependencyLogger interface {
+	// Log a dependency with the specified name, type, target, duration, success status and
+	// result code.
+	Dependency(name string, dependencyType string, target string, duration time.Duration, success bool, resultCode string, context IrisLogContext)
+}
+
+// AvailabilityLogger is implemented by loggers that can log the results of availability
+// tests, such as health checks.
+type AvailabilityLogger interface {
+	// Log an availability test result with the specified test name, duration, success
+	// status and message.
+	Availability(name string, duration time.Duration, success bool, message string, context IrisLogContext)
+}
+
+// ClosableLogger is implemented by loggers that queue telemetry, and need to be closed to
+// send it before the process exits.
+type ClosableLogger interface {
+	// Send any queued telemetry and stop the logger, waiting at most timeout. Nothing
+	// should be logged after calling Close.
+	Close(timeout time.Duration)
+}
 
+// StatsLogger is implemented by loggers that can tell whether their telemetry is being
+// delivered, as the loggers of NewLogger can.
+type StatsLogger interface {
+	// Return the counters of the telemetry queued, dropped and sent.
+	Stats() PipelineStats
 }
 
 type IrisLogContext struct {
 	CorrelationId string
 	UserId        string
+	OperationName string
+
+	// SpanId identifies the request or operation being handled, and ParentId the one that
+	// started it. Requests are logged with SpanId as their id, and everything else,
+	// dependencies included, as a child of SpanId. HttpRequestHandler and StartOperation
+	// set them.
+	SpanId   string
+	ParentId string
+
+	// DependencyId, if set, is the id a dependency logged with this context gets, rather
+	// than a new one. Span.End sets it to the span's SpanId, so that the telemetry logged
+	// within the span is linked to the dependency.
+	DependencyId string
+
+	// Properties are added to all telemetry logged with this context. HttpRequestHandler
+	// creates the map before calling the handler, so middleware can add to it and have
+	// the values show up on the request telemetry.
+	Properties map[string]string
+}
+
+type logContextKey struct{}
+
+// WithLogContext returns a copy of ctx carrying the log context, so that code further down
+// the call chain can log against the same request.
+func WithLogContext(ctx context.Context, logContext IrisLogContext) context.Context {
+	return context.WithValue(ctx, logContextKey{}, logContext)
+}
+
+// LogContextFrom returns the log context carried by ctx, or an empty one if there is none.
+func LogContextFrom(ctx context.Context) IrisLogContext {
+	if ctx == nil {
+		return IrisLogContext{}
+	}
+	logContext, _ := ctx.Value(logContextKey{}).(IrisLogContext)
+	return logContext
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying the logger, for StartOperation to log to.
+// HttpRequestHandler adds its logger to the request context.
+func WithLogger(ctx context.Context, logger IrisLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFrom returns the logger carried by ctx, or nil if there is none.
+func LoggerFrom(ctx context.Context) IrisLogger {
+	if ctx == nil {
+		return nil
+	}
+	logger, _ := ctx.Value(loggerKey{}).(IrisLogger)
+	return logger
 }
 
 type irisLogClient struct {
-	client appinsights.TelemetryClient
+	client   appinsights.TelemetryClient
+	pipeline *TelemetryPipeline
+}
+
+// track queues the telemetry in the pipeline.
+func (log irisLogClient) track(telemetry appinsights.Telemetry) {
+	if !log.client.IsEnabled() {
+		return
+	}
+	log.pipeline.add(pipelineItem{
+		Severity: telemetrySeverity(telemetry),
+		Envelope: envelop(log.client.Context(), telemetry),
+	})
 }
 
 func (log irisLogClient) Metric(name string, value float64, context IrisLogContext) {
@@ -57,13 +165,43 @@ func (log irisLogClient) Metric(name string, value float64, context IrisLogConte
 	if context.CorrelationId != "" {
 		telemetry.Tags.Session().SetId(context.CorrelationId)
 	}
-	log.client.Track(telemetry)
+	if context.OperationName != "" {
+		telemetry.Tags.Operation().SetName(context.OperationName)
+	}
+	addOperationIds(telemetry.Tags, context.CorrelationId, context.SpanId)
+	addContextProperties(telemetry.Properties, context)
+	log.track(telemetry)
+}
+
+func (log irisLogClient) MetricSummary(name string, summary MetricSummary, context IrisLogContext) {
+	telemetry := appinsights.NewAggregateMetricTelemetry(name)
+	telemetry.Value = summary.Sum
+	telemetry.Count = summary.Count
+	telemetry.Min = summary.Min
+	telemetry.Max = summary.Max
+	telemetry.StdDev = summary.StdDev
+	for p, value := range summary.Percentiles {
+		telemetry.Properties[percentileName(p)] = strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	if context.UserId != "" {
+		telemetry.Tags.User().SetAccountId(context.UserId)
+		telemetry.Tags[contracts.UserAccountId] = context.UserId
+	}
+	if context.CorrelationId != "" {
+		telemetry.Tags.Session().SetId(context.CorrelationId)
+	}
+	if context.OperationName != "" {
+		telemetry.Tags.Operation().SetName(context.OperationName)
+	}
+	addOperationIds(telemetry.Tags, context.CorrelationId, context.SpanId)
+	addContextProperties(telemetry.Properties, context)
+	log.track(telemetry)
 }
 
 func (log irisLogClient) Info(code string, message string, data map[string]string, context IrisLogContext) {
 	telemetry := appinsights.NewTraceTelemetry(message, appinsights.Information)
-	if data != nil {
-		telemetry.Properties = data
+	for k, v := range data {
+		telemetry.Properties[k] = v
 	}
 	if context.UserId != "" {
 		telemetry.Tags.User().SetAccountId(context.UserId)
@@ -72,14 +210,19 @@ func (log irisLogClient) Info(code string, message string, data map[string]strin
 	if context.CorrelationId != "" {
 		telemetry.Tags.Session().SetId(context.CorrelationId)
 	}
+	if context.OperationName != "" {
+		telemetry.Tags.Operation().SetName(context.OperationName)
+	}
+	addOperationIds(telemetry.Tags, context.CorrelationId, context.SpanId)
+	addContextProperties(telemetry.Properties, context)
 
 	telemetry.Properties["event_code"] = code
-	log.client.Track(telemetry)
+	log.track(telemetry)
 }
 func (log irisLogClient) Warning(code string, message string, data map[string]string, context IrisLogContext) {
 	telemetry := appinsights.NewTraceTelemetry(message, appinsights.Warning)
-	if data != nil {
-		telemetry.Properties = data
+	for k, v := range data {
+		telemetry.Properties[k] = v
 	}
 	if context.UserId != "" {
 		telemetry.Tags.User().SetAccountId(context.UserId)
@@ -88,16 +231,22 @@ func (log irisLogClient) Warning(code string, message string, data map[string]st
 	if context.CorrelationId != "" {
 		telemetry.Tags.Session().SetId(context.CorrelationId)
 	}
+	if context.OperationName != "" {
+		telemetry.Tags.Operation().SetName(context.OperationName)
+	}
+	addOperationIds(telemetry.Tags, context.CorrelationId, context.SpanId)
+	addContextProperties(telemetry.Properties, context)
 
 	telemetry.Properties["event_code"] = code
-	log.client.Track(telemetry)
+	log.track(telemetry)
 }
 func (log irisLogClient) Error(code string, err interface{}, data map[string]string, context IrisLogContext) {
 	telemetry := newExceptionTelemetry(err, 1)
-	if data != nil {
-		telemetry.Properties = data
+	for k, v := range data {
+		telemetry.Properties[k] = v
 	}
 	telemetry.Properties["event_code"] = code
+	addErrorListProperties(telemetry.Properties, err)
 	if context.UserId != "" {
 		telemetry.Tags.User().SetAccountId(context.UserId)
 		telemetry.Tags[contracts.UserAccountId] = context.UserId
@@ -105,9 +254,51 @@ func (log irisLogClient) Error(code string, err interface{}, data map[string]str
 	if context.CorrelationId != "" {
 		telemetry.Tags.Session().SetId(context.CorrelationId)
 	}
-	telemetry.Tags[contracts.OperationName] = "handleHomeGet"
+	if context.OperationName != "" {
+		telemetry.Tags.Operation().SetName(context.OperationName)
+	}
+	addOperationIds(telemetry.Tags, context.CorrelationId, context.SpanId)
+	addContextProperties(telemetry.Properties, context)
+
+	log.track(telemetry)
+}
+
+// addOperationIds links the telemetry to the other telemetry of the operation, with the
+// correlation id as the operation id.
+func addOperationIds(tags contracts.ContextTags, operationId string, parentId string) {
+	if operationId != "" {
+		tags.Operation().SetId(operationId)
+	}
+	if parentId != "" {
+		tags.Operation().SetParentId(parentId)
+	}
+}
+
+// addContextProperties adds the properties of the log context, without replacing values
+// that were passed in explicitly.
+func addContextProperties(properties map[string]string, context IrisLogContext) {
+	for k, v := range context.Properties {
+		if _, ok := properties[k]; !ok {
+			properties[k] = v
+		}
+	}
+}
 
-	log.client.Track(telemetry)
+// addErrorListProperties adds the individual errors of an ErrorList to the properties,
+// since only the aggregated error message would be reported otherwise.
+func addErrorListProperties(properties map[string]string, err interface{}) {
+	e, ok := err.(error)
+	if !ok {
+		return
+	}
+	iriserr, ok := As(e)
+	if !ok || len(iriserr.Errors) == 0 {
+		return
+	}
+	properties["error_count"] = strconv.Itoa(len(iriserr.Errors))
+	if bytes, marshalErr := json.Marshal(iriserr.Errors); marshalErr == nil {
+		properties["errors"] = string(bytes)
+	}
 }
 
 func newExceptionTelemetry(err interface{}, skip int) *appinsights.ExceptionTelemetry {
@@ -154,22 +345,123 @@ func (log irisLogClient) Request(method string, url string, duration time.Durati
 	if context.CorrelationId != "" {
 		telemetry.Tags.Session().SetId(context.CorrelationId)
 	}
+	if context.OperationName != "" {
+		telemetry.Tags.Operation().SetName(context.OperationName)
+	}
+	if context.SpanId != "" {
+		telemetry.Id = context.SpanId
+	}
+	addOperationIds(telemetry.Tags, context.CorrelationId, context.ParentId)
+	addContextProperties(telemetry.Properties, context)
 
 	// Finally track it
-	log.client.Track(telemetry)
+	log.track(telemetry)
+}
+
+func (log irisLogClient) Dependency(name string, dependencyType string, target string, duration time.Duration, success bool, resultCode string, context IrisLogContext) {
+	telemetry := appinsights.NewRemoteDependencyTelemetry(name, dependencyType, target, success)
+	end := currentClock.Now()
+	telemetry.MarkTime(end.Add(-duration), end)
+	telemetry.ResultCode = resultCode
+	if context.UserId != "" {
+		telemetry.Tags.User().SetAccountId(context.UserId)
+		telemetry.Tags[contracts.UserAccountId] = context.UserId
+	}
+	if context.CorrelationId != "" {
+		telemetry.Tags.Session().SetId(context.CorrelationId)
+	}
+	if context.OperationName != "" {
+		telemetry.Tags.Operation().SetName(context.OperationName)
+	}
+	telemetry.Id = context.DependencyId
+	if telemetry.Id == "" {
+		telemetry.Id = uuid.New().String()
+	}
+	addOperationIds(telemetry.Tags, context.CorrelationId, context.SpanId)
+	addContextProperties(telemetry.Properties, context)
+	log.track(telemetry)
 }
 
-func NewLogger(instrumentationKey string, serviceName string) IrisLogger {
+func (log irisLogClient) Availability(name string, duration time.Duration, success bool, message string, context IrisLogContext) {
+	telemetry := appinsights.NewAvailabilityTelemetry(name, duration, success)
+	telemetry.Message = message
+	if context.UserId != "" {
+		telemetry.Tags.User().SetAccountId(context.UserId)
+		telemetry.Tags[contracts.UserAccountId] = context.UserId
+	}
+	if context.CorrelationId != "" {
+		telemetry.Tags.Session().SetId(context.CorrelationId)
+	}
+	if context.OperationName != "" {
+		telemetry.Tags.Operation().SetName(context.OperationName)
+	}
+	addOperationIds(telemetry.Tags, context.CorrelationId, context.SpanId)
+	addContextProperties(telemetry.Properties, context)
+	log.track(telemetry)
+}
+
+func (log irisLogClient) Stats() PipelineStats {
+	return log.pipeline.Stats()
+}
+
+func (log irisLogClient) Close(timeout time.Duration) {
+	start := currentClock.Now()
+	log.pipeline.close(timeout)
+	timeout -= currentClock.Since(start)
+	// Nothing is sent through the channel, but closing it stops its goroutine.
+	select {
+	case <-log.client.Channel().Close(timeout):
+	case <-currentClock.After(timeout):
+	}
+}
+
+// LoggerOption configures NewLogger.
+type LoggerOption func(options *loggerOptions)
+
+type loggerOptions struct {
+	pipeline *TelemetryPipeline
+	endpoint string
+}
+
+// WithPipeline sends telemetry through the pipeline, instead of one with the default
+// settings, such as to set its drop policy or receive its Diagnostics. A pipeline can only
+// be given to one logger.
+func WithPipeline(pipeline *TelemetryPipeline) LoggerOption {
+	return func(options *loggerOptions) {
+		options.pipeline = pipeline
+	}
+}
+
+// WithEndpoint sends telemetry to an ingestion endpoint other than Application Insights',
+// such as a goservicetest.FakeIngestion in tests.
+func WithEndpoint(endpoint string) LoggerOption {
+	return func(options *loggerOptions) {
+		options.endpoint = endpoint
+	}
+}
+
+// NewLogger returns a logger that sends telemetry to Application Insights, through a
+// TelemetryPipeline. It implements StatsLogger, to see whether the telemetry is delivered.
+func NewLogger(instrumentationKey string, serviceName string, opts ...LoggerOption) IrisLogger {
+	options := &loggerOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
 	initClock()
 	telemetryConfig := appinsights.NewTelemetryConfiguration(instrumentationKey)
-	// Configure how many items can be sent in one call to the data collector:
-	telemetryConfig.MaxBatchSize = 8192
-	// Configure the maximum delay before sending queued telemetry:
-	telemetryConfig.MaxBatchInterval = 2 * time.Second
+	if options.endpoint != "" {
+		telemetryConfig.EndpointUrl = options.endpoint
+	}
 	client := appinsights.NewTelemetryClientFromConfig(telemetryConfig)
 	client.Context().Tags.Cloud().SetRole(serviceName)
 
-	return &irisLogClient{
-		client,
+	if options.pipeline == nil {
+		options.pipeline = NewTelemetryPipeline(PipelineSettings{})
+	}
+	logger := &irisLogClient{
+		client:   client,
+		pipeline: options.pipeline,
 	}
+	options.pipeline.start(newHTTPSink(telemetryConfig.EndpointUrl, telemetryConfig.Client), logger)
+	return logger
 }
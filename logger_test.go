@@ -0,0 +1,80 @@
+package goservice
+
+import (
+	"sync"
+	"time"
+)
+
+// loggedTelemetry is an item logged to a recordingLogger.
+type loggedTelemetry struct {
+	Kind         string
+	Name         string
+	Message      string
+	Value        float64
+	Summary      MetricSummary
+	Data         map[string]string
+	ResponseCode string
+	Success      bool
+	Context      IrisLogContext
+}
+
+// recordingLogger is an IrisLogger that keeps what is logged to it, for tests.
+type recordingLogger struct {
+	mu    sync.Mutex
+	items []loggedTelemetry
+}
+
+func (l *recordingLogger) log(item loggedTelemetry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.items = append(l.items, item)
+}
+
+// byKind returns the items of a kind, such as "request", "dependency" or "close".
+func (l *recordingLogger) byKind(kind string) []loggedTelemetry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var items []loggedTelemetry
+	for _, item := range l.items {
+		if item.Kind == kind {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (l *recordingLogger) Metric(name string, value float64, context IrisLogContext) {
+	l.log(loggedTelemetry{Kind: "metric", Name: name, Value: value, Context: context})
+}
+
+func (l *recordingLogger) MetricSummary(name string, summary MetricSummary, context IrisLogContext) {
+	l.log(loggedTelemetry{Kind: "metric_summary", Name: name, Summary: summary, Context: context})
+}
+
+func (l *recordingLogger) Info(code string, message string, data map[string]string, context IrisLogContext) {
+	l.log(loggedTelemetry{Kind: "info", Name: code, Message: message, Data: data, Context: context})
+}
+
+func (l *recordingLogger) Warning(code string, message string, data map[string]string, context IrisLogContext) {
+	l.log(loggedTelemetry{Kind: "warning", Name: code, Message: message, Data: data, Context: context})
+}
+
+func (l *recordingLogger) Error(code string, err interface{}, data map[string]string, context IrisLogContext) {
+	l.log(loggedTelemetry{Kind: "error", Name: code, Data: data, Context: context})
+}
+
+func (l *recordingLogger) Request(method string, url string, duration time.Duration, responseCode string, clientAddress string, context IrisLogContext) {
+	l.log(loggedTelemetry{Kind: "request", Name: method + " " + url, ResponseCode: responseCode, Context: context})
+}
+
+func (l *recordingLogger) Dependency(name string, dependencyType string, target string, duration time.Duration, success bool, resultCode string, context IrisLogContext) {
+	l.log(loggedTelemetry{Kind: "dependency", Name: name, ResponseCode: resultCode, Success: success, Context: context})
+}
+
+func (l *recordingLogger) Availability(name string, duration time.Duration, success bool, message string, context IrisLogContext) {
+	l.log(loggedTelemetry{Kind: "availability", Name: name, Message: message, Success: success, Context: context})
+}
+
+func (l *recordingLogger) Close(timeout time.Duration) {
+	l.log(loggedTelemetry{Kind: "close"})
+}
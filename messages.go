@@ -0,0 +1,147 @@
+package goservice
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// genericPublicMessage is sent instead of the internal message of server errors when
+// running in production mode and no catalog message exists for the error.
+const genericPublicMessage = "An internal error occurred"
+
+// MessageCatalog holds the user-facing messages for error codes in each locale.
+// Messages are templates in which `{name}` is replaced by the error's `name` param.
+// Codes are looked up by prefix, so a message for `bad_request` is used for any
+// `bad_request.*` error that has no message of its own.
+type MessageCatalog struct {
+	defaultLocale string
+	messages      map[string]map[string]string
+}
+
+// NewMessageCatalog returns an empty catalog that falls back to defaultLocale when a
+// client doesn't accept any of the catalog's locales.
+func NewMessageCatalog(defaultLocale string) *MessageCatalog {
+	return &MessageCatalog{
+		defaultLocale: normalizeLocale(defaultLocale),
+		messages:      map[string]map[string]string{},
+	}
+}
+
+// Add sets the message template for the code in the given locale.
+func (c *MessageCatalog) Add(locale string, code string, template string) {
+	locale = normalizeLocale(locale)
+	if c.messages[locale] == nil {
+		c.messages[locale] = map[string]string{}
+	}
+	c.messages[locale][code] = template
+}
+
+// AddMessages sets several message templates, keyed by code, for the given locale.
+func (c *MessageCatalog) AddMessages(locale string, templates map[string]string) {
+	for code, template := range templates {
+		c.Add(locale, code, template)
+	}
+}
+
+// Locale picks the catalog locale that best matches an Accept-Language header. Languages
+// are tried in order of preference, first exactly and then by their base language, so
+// `en-GB` will use an `en` catalog. The default locale is returned if nothing matches.
+func (c *MessageCatalog) Locale(acceptLanguage string) string {
+	for _, language := range parseAcceptLanguage(acceptLanguage) {
+		if _, ok := c.messages[language]; ok {
+			return language
+		}
+		if i := strings.Index(language, "-"); i > 0 {
+			if _, ok := c.messages[language[:i]]; ok {
+				return language[:i]
+			}
+		}
+	}
+	return c.defaultLocale
+}
+
+// Message returns the message for the error in the locale, interpolated with the error's
+// params, falling back to the default locale. It returns false if no message is found.
+func (c *MessageCatalog) Message(locale string, err *IrisError) (string, bool) {
+	message, _, ok := c.message(locale, err)
+	return message, ok
+}
+
+// message is Message, also returning the locale the message was found in.
+func (c *MessageCatalog) message(locale string, err *IrisError) (string, string, bool) {
+	for _, l := range []string{normalizeLocale(locale), c.defaultLocale} {
+		if template, ok := lookupCode(c.messages[l], err.Code); ok {
+			return interpolate(template, err.Params), l, true
+		}
+	}
+	return "", "", false
+}
+
+// lookupCode finds the template for the code, dropping dotted parts from the end of the
+// code until a template is found.
+func lookupCode(templates map[string]string, code string) (string, bool) {
+	for code != "" {
+		if template, ok := templates[code]; ok {
+			return template, true
+		}
+		i := strings.LastIndex(code, ".")
+		if i < 0 {
+			break
+		}
+		code = code[:i]
+	}
+	return "", false
+}
+
+func interpolate(template string, params map[string]string) string {
+	if len(params) == 0 {
+		return template
+	}
+	replacements := make([]string, 0, 2*len(params))
+	for k, v := range params {
+		replacements = append(replacements, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// parseAcceptLanguage returns the languages of an Accept-Language header, most preferred
+// first. Languages with a quality of zero are dropped.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		language string
+		quality  float64
+	}
+	var languages []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		language := normalizeLocale(fields[0])
+		if language == "" || language == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, field := range fields[1:] {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "q=") {
+				if q, err := strconv.ParseFloat(field[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, weighted{language, quality})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+	output := make([]string, len(languages))
+	for i, l := range languages {
+		output[i] = l.language
+	}
+	return output
+}
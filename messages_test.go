@@ -0,0 +1,71 @@
+package goservice
+
+import (
+	"testing"
+)
+
+func newTestCatalog() *MessageCatalog {
+	catalog := NewMessageCatalog("en")
+	catalog.AddMessages("en", map[string]string{
+		"bad_request":         "The request is invalid",
+		"bad_request.missing": "{field} is required",
+		"not_found":           "Not found",
+	})
+	catalog.AddMessages("fr", map[string]string{
+		"bad_request.missing": "{field} est obligatoire",
+	})
+	catalog.Add("pt_BR", "bad_request", "A solicitação é inválida")
+	return catalog
+}
+
+func TestMessageCatalogLocale(t *testing.T) {
+	catalog := newTestCatalog()
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "en"},
+		{"fr", "fr"},
+		{"fr-CA", "fr"},
+		{"FR-ca", "fr"},
+		{"pt-BR", "pt-br"},
+		{"de, fr;q=0.5", "fr"},
+		{"en;q=0.2, fr;q=0.8", "fr"},
+		{"fr;q=0, en", "en"},
+		{"*, fr", "fr"},
+		{"de", "en"},
+		{"fr;q=invalid, de", "fr"},
+	}
+	for _, test := range tests {
+		if got := catalog.Locale(test.acceptLanguage); got != test.want {
+			t.Errorf("Locale(%q) = %q, want %q", test.acceptLanguage, got, test.want)
+		}
+	}
+}
+
+func TestMessageCatalogMessage(t *testing.T) {
+	catalog := newTestCatalog()
+	tests := []struct {
+		name   string
+		locale string
+		err    *IrisError
+		want   string
+		found  bool
+	}{
+		{"exact code", "en", BadRequest("missing", "", map[string]string{"field": "name"}), "name is required", true},
+		{"translated", "fr", BadRequest("missing", "", map[string]string{"field": "name"}), "name est obligatoire", true},
+		{"code prefix", "en", BadRequest("missing.nested", "", map[string]string{"field": "age"}), "age is required", true},
+		{"type code", "en", BadRequest("invalid", "", nil), "The request is invalid", true},
+		{"default locale", "fr", NotFound("user", "", nil), "Not found", true},
+		{"no message", "en", Unavailable("db", "", nil), "", false},
+		{"missing param", "en", BadRequest("missing", "", nil), "{field} is required", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, found := catalog.Message(test.locale, test.err)
+			if got != test.want || found != test.found {
+				t.Errorf("got %q, %v, want %q, %v", got, found, test.want, test.found)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package goservice
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of metric kept by a MetricsRegistry.
+const (
+	METRIC_COUNTER   = "counter"
+	METRIC_GAUGE     = "gauge"
+	METRIC_HISTOGRAM = "histogram"
+)
+
+// MetricSummary aggregates the values of a metric over an interval. For counters, Sum is
+// the total added. A gauge is summarised as its last value, with a Count of 1 and the
+// value as Sum, Min and Max.
+type MetricSummary struct {
+	// Kind is the kind of metric, such as METRIC_GAUGE.
+	Kind        string
+	Count       int
+	Sum         float64
+	Min         float64
+	Max         float64
+	StdDev      float64
+	Percentiles map[float64]float64
+}
+
+// percentileName names a percentile for telemetry, e.g. `p95` or `p99.9`.
+func percentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p*100, 'f', -1, 64)
+}
+
+// histogramReservoirSize is the number of values kept per histogram series to estimate
+// percentiles.
+const histogramReservoirSize = 1024
+
+// MetricsSettings configures a MetricsRegistry. Zero fields are replaced by the defaults
+// noted on them.
+type MetricsSettings struct {
+	// Logger receives a MetricSummary for each series at every flush, so it must be a
+	// MetricSummaryLogger. Optional, for a registry that is only exposed to Prometheus.
+	Logger IrisLogger
+	// Interval is the time between flushes. Defaults to 60s.
+	Interval time.Duration
+	// Percentiles are reported for histograms, as fractions in (0, 1], e.g. 0.95 rather
+	// than 95. Defaults to 0.5, 0.95, 0.99.
+	Percentiles []float64
+	// Buckets are the upper bounds of the histogram buckets exposed to Prometheus, in
+	// increasing order. Defaults to the Prometheus client defaults, suited to seconds.
+	Buckets []float64
+}
+
+// MetricsRegistry aggregates metrics in process and sends one summary per series at each
+// interval, instead of one telemetry item per value. A series is a metric name together
+// with a set of dimensions, which are sent as properties of the summary.
+type MetricsRegistry struct {
+	settings MetricsSettings
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	name       string
+	kind       string
+	dimensions map[string]string
+	// set is whether a gauge has had a value.
+	set bool
+
+	// Values since the series was created, for Prometheus.
+	total      float64
+	totalCount int
+	buckets    []int
+
+	// Values since the last flush.
+	count     int
+	sum       float64
+	min       float64
+	max       float64
+	mean      float64
+	m2        float64
+	reservoir []float64
+}
+
+// NewMetricsRegistry creates an empty registry. Call Start to flush it in the background.
+// It panics if the logger is not a MetricSummaryLogger, a percentile is outside (0, 1], or
+// the buckets are not in increasing order.
+func NewMetricsRegistry(settings MetricsSettings) *MetricsRegistry {
+	if settings.Interval <= 0 {
+		settings.Interval = 60 * time.Second
+	}
+	if len(settings.Percentiles) == 0 {
+		settings.Percentiles = []float64{0.5, 0.95, 0.99}
+	}
+	if len(settings.Buckets) == 0 {
+		settings.Buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	}
+	if _, ok := settings.Logger.(MetricSummaryLogger); settings.Logger != nil && !ok {
+		panic("goservice: MetricsSettings.Logger must be a MetricSummaryLogger")
+	}
+	for _, p := range settings.Percentiles {
+		if !(p > 0 && p <= 1) {
+			panic("goservice: MetricsSettings.Percentiles must be fractions in (0, 1], got " + strconv.FormatFloat(p, 'g', -1, 64))
+		}
+	}
+	for i := 1; i < len(settings.Buckets); i++ {
+		if !(settings.Buckets[i] > settings.Buckets[i-1]) {
+			panic("goservice: MetricsSettings.Buckets must be in increasing order")
+		}
+	}
+	return &MetricsRegistry{
+		settings: settings,
+		stop:     make(chan struct{}),
+		series:   map[string]*metricSeries{},
+	}
+}
+
+// Start flushes the registry every interval until Stop is called.
+func (r *MetricsRegistry) Start() {
+	ticker := currentClock.NewTicker(r.settings.Interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C():
+				r.Flush()
+			}
+		}
+	}()
+}
+
+// Stop stops the background flushes, and flushes what has been recorded since the last.
+func (r *MetricsRegistry) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.Flush()
+	})
+}
+
+// Counter is a metric that is added to, such as a number of requests.
+type Counter struct {
+	registry *MetricsRegistry
+	name     string
+}
+
+// Add adds value to the series for the dimensions.
+func (c *Counter) Add(value float64, dimensions map[string]string) {
+	c.registry.record(c.name, METRIC_COUNTER, value, dimensions)
+}
+
+// Gauge is a metric that is set to its current value, such as a queue length.
+type Gauge struct {
+	registry *MetricsRegistry
+	name     string
+}
+
+// Set records the current value of the series for the dimensions. The last value is
+// reported, and keeps being reported until it is set again.
+func (g *Gauge) Set(value float64, dimensions map[string]string) {
+	g.registry.record(g.name, METRIC_GAUGE, value, dimensions)
+}
+
+// Histogram is a metric whose distribution matters, such as request durations.
+type Histogram struct {
+	registry *MetricsRegistry
+	name     string
+}
+
+// Observe records a value of the series for the dimensions.
+func (h *Histogram) Observe(value float64, dimensions map[string]string) {
+	h.registry.record(h.name, METRIC_HISTOGRAM, value, dimensions)
+}
+
+// Counter returns the counter with the given name.
+func (r *MetricsRegistry) Counter(name string) *Counter {
+	return &Counter{registry: r, name: name}
+}
+
+// Gauge returns the gauge with the given name.
+func (r *MetricsRegistry) Gauge(name string) *Gauge {
+	return &Gauge{registry: r, name: name}
+}
+
+// Histogram returns the histogram with the given name.
+func (r *MetricsRegistry) Histogram(name string) *Histogram {
+	return &Histogram{registry: r, name: name}
+}
+
+// seriesKey identifies a series by its name and sorted dimensions.
+func seriesKey(name string, dimensions map[string]string) string {
+	keys := make([]string, 0, len(dimensions))
+	for k := range dimensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	key := strings.Builder{}
+	key.WriteString(name)
+	for _, k := range keys {
+		key.WriteString("\x00")
+		key.WriteString(k)
+		key.WriteString("=")
+		key.WriteString(dimensions[k])
+	}
+	return key.String()
+}
+
+func (r *MetricsRegistry) record(name string, kind string, value float64, dimensions map[string]string) {
+	key := seriesKey(name, dimensions)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	series, ok := r.series[key]
+	if !ok {
+		series = &metricSeries{name: name, kind: kind, dimensions: copyProperties(dimensions)}
+		if kind == METRIC_HISTOGRAM {
+			series.buckets = make([]int, len(r.settings.Buckets))
+		}
+		r.series[key] = series
+	}
+	series.observe(value, r.settings.Buckets)
+}
+
+func (s *metricSeries) observe(value float64, buckets []float64) {
+	if s.kind == METRIC_GAUGE {
+		s.sum = value
+		s.set = true
+	} else {
+		s.sum += value
+	}
+	s.total += value
+	s.totalCount++
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.count++
+	// Welford's algorithm keeps the variance without storing every value.
+	delta := value - s.mean
+	s.mean += delta / float64(s.count)
+	s.m2 += delta * (value - s.mean)
+
+	if s.kind != METRIC_HISTOGRAM {
+		return
+	}
+	if i := sort.SearchFloat64s(buckets, value); i < len(s.buckets) {
+		s.buckets[i]++
+	}
+	// Reservoir sampling keeps a uniform sample of the values for percentiles.
+	if len(s.reservoir) < histogramReservoirSize {
+		s.reservoir = append(s.reservoir, value)
+	} else if i := rand.Intn(s.count); i < histogramReservoirSize {
+		s.reservoir[i] = value
+	}
+}
+
+// summary returns the summary of the values since the last flush and resets them.
+// It returns false if there is nothing to report.
+func (s *metricSeries) summary(percentiles []float64) (MetricSummary, bool) {
+	if s.kind == METRIC_GAUGE {
+		// Gauges report their last value, whether or not it was set since the last flush.
+		s.count, s.mean, s.m2 = 0, 0, 0
+		return MetricSummary{Kind: METRIC_GAUGE, Count: 1, Sum: s.sum, Min: s.sum, Max: s.sum}, s.set
+	}
+	if s.count == 0 {
+		return MetricSummary{}, false
+	}
+	summary := MetricSummary{
+		Kind:   s.kind,
+		Count:  s.count,
+		Sum:    s.sum,
+		Min:    s.min,
+		Max:    s.max,
+		StdDev: math.Sqrt(s.m2 / float64(s.count)),
+	}
+	if s.kind == METRIC_HISTOGRAM && len(s.reservoir) > 0 {
+		sort.Float64s(s.reservoir)
+		summary.Percentiles = map[float64]float64{}
+		for _, p := range percentiles {
+			i := int(math.Ceil(p*float64(len(s.reservoir)))) - 1
+			if i < 0 {
+				i = 0
+			}
+			summary.Percentiles[p] = s.reservoir[i]
+		}
+	}
+	s.count, s.sum, s.mean, s.m2, s.reservoir = 0, 0, 0, 0, s.reservoir[:0]
+	return summary, true
+}
+
+// Flush sends a summary of every series that has something to report.
+func (r *MetricsRegistry) Flush() {
+	type flushed struct {
+		name       string
+		summary    MetricSummary
+		dimensions map[string]string
+	}
+	r.mu.Lock()
+	var items []flushed
+	for _, series := range r.series {
+		if summary, ok := series.summary(r.settings.Percentiles); ok {
+			items = append(items, flushed{series.name, summary, series.dimensions})
+		}
+	}
+	r.mu.Unlock()
+
+	logger, ok := r.settings.Logger.(MetricSummaryLogger)
+	if !ok {
+		return
+	}
+	for _, item := range items {
+		logger.MetricSummary(item.name, item.summary, IrisLogContext{Properties: item.dimensions})
+	}
+}
@@ -0,0 +1,138 @@
+package goservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewMetricsRegistryRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings MetricsSettings
+	}{
+		{"percent instead of fraction", MetricsSettings{Percentiles: []float64{95}}},
+		{"zero percentile", MetricsSettings{Percentiles: []float64{0}}},
+		{"unsorted buckets", MetricsSettings{Buckets: []float64{1, 0.5}}},
+		{"repeated bucket", MetricsSettings{Buckets: []float64{1, 1}}},
+		{"logger without summaries", MetricsSettings{Logger: plainLogger{}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("NewMetricsRegistry accepted the settings")
+				}
+			}()
+			NewMetricsRegistry(test.settings)
+		})
+	}
+}
+
+func TestMetricsRegistryFlush(t *testing.T) {
+	logger := &recordingLogger{}
+	registry := NewMetricsRegistry(MetricsSettings{Logger: logger, Percentiles: []float64{0.5, 1}})
+	histogram := registry.Histogram("latency")
+	for i := 1; i <= 10; i++ {
+		histogram.Observe(float64(i), map[string]string{"route": "/users"})
+	}
+	registry.Flush()
+
+	summaries := logger.byKind("metric_summary")
+	if len(summaries) != 1 || summaries[0].Name != "latency" {
+		t.Fatalf("got %v, want one summary of latency", summaries)
+	}
+	if summaries[0].Context.Properties["route"] != "/users" {
+		t.Errorf("got properties %v, want the dimensions", summaries[0].Context.Properties)
+	}
+
+	registry.Flush()
+	if len(logger.byKind("metric_summary")) != 1 {
+		t.Error("a histogram without new values was flushed again")
+	}
+}
+
+func TestMetricSeriesPercentiles(t *testing.T) {
+	series := &metricSeries{kind: METRIC_HISTOGRAM, buckets: make([]int, 1)}
+	for i := 1; i <= 100; i++ {
+		series.observe(float64(i), []float64{1000})
+	}
+	summary, ok := series.summary([]float64{0.5, 0.95, 1})
+	if !ok {
+		t.Fatal("no summary")
+	}
+	for p, want := range map[float64]float64{0.5: 50, 0.95: 95, 1: 100} {
+		if got := summary.Percentiles[p]; got != want {
+			t.Errorf("%s = %v, want %v", percentileName(p), got, want)
+		}
+	}
+	if summary.Count != 100 || summary.Sum != 5050 || summary.Min != 1 || summary.Max != 100 {
+		t.Errorf("got %+v", summary)
+	}
+}
+
+// plainLogger is an IrisLogger with none of the optional interfaces.
+type plainLogger struct{}
+
+func (plainLogger) Metric(name string, value float64, context IrisLogContext) {}
+
+func (plainLogger) Info(code string, message string, data map[string]string, context IrisLogContext) {
+}
+
+func (plainLogger) Warning(code string, message string, data map[string]string, context IrisLogContext) {
+}
+
+func (plainLogger) Error(code string, err interface{}, data map[string]string, context IrisLogContext) {
+}
+
+func (plainLogger) Request(method string, url string, duration time.Duration, responseCode string, clientAddress string, context IrisLogContext) {
+}
+
+func TestMetricsRegistryFlushesGaugesAsTheirLastValue(t *testing.T) {
+	logger := &recordingLogger{}
+	registry := NewMetricsRegistry(MetricsSettings{Logger: logger})
+	gauge := registry.Gauge("queue_length")
+	registry.Flush()
+	if summaries := logger.byKind("metric_summary"); len(summaries) != 0 {
+		t.Fatalf("got %v for a gauge that was never set", summaries)
+	}
+
+	for _, value := range []float64{10, 30, 20} {
+		gauge.Set(value, nil)
+	}
+	registry.Flush()
+	registry.Flush()
+
+	want := MetricSummary{Kind: METRIC_GAUGE, Count: 1, Sum: 20, Min: 20, Max: 20}
+	summaries := logger.byKind("metric_summary")
+	if len(summaries) != 2 {
+		t.Fatalf("got %d summaries, want one per flush", len(summaries))
+	}
+	for _, summary := range summaries {
+		if summary.Summary.Kind != want.Kind || summary.Summary.Count != want.Count || summary.Summary.Sum != want.Sum ||
+			summary.Summary.Min != want.Min || summary.Summary.Max != want.Max || summary.Summary.StdDev != 0 {
+			t.Errorf("got %+v, want %+v", summary.Summary, want)
+		}
+	}
+}
+
+func TestMetricsRegistryFlushesCounters(t *testing.T) {
+	logger := &recordingLogger{}
+	registry := NewMetricsRegistry(MetricsSettings{Logger: logger})
+	counter := registry.Counter("requests")
+	counter.Add(1, nil)
+	counter.Add(2, nil)
+	registry.Flush()
+	counter.Add(4, nil)
+	registry.Flush()
+
+	summaries := logger.byKind("metric_summary")
+	if len(summaries) != 2 {
+		t.Fatalf("got %d summaries, want 2", len(summaries))
+	}
+	if got := summaries[0].Summary; got.Kind != METRIC_COUNTER || got.Count != 2 || got.Sum != 3 {
+		t.Errorf("got %+v for the first interval", got)
+	}
+	if got := summaries[1].Summary; got.Count != 1 || got.Sum != 4 {
+		t.Errorf("got %+v for the second interval, want only what was added since", got)
+	}
+}
@@ -0,0 +1,48 @@
+package goservice
+
+import (
+	"net/http"
+)
+
+// Middleware wraps a handler with extra behaviour, such as authentication or rate limiting.
+// It can return an IrisError itself to stop the request before it reaches next.
+type Middleware func(next HttpRequestHandlerFunc) HttpRequestHandlerFunc
+
+// Chain composes middleware in order. The first middleware is the outermost, so it sees the
+// request first and the returned error last. Chains are immutable; Append returns a new
+// chain, so a common base chain can be shared between routes.
+type Chain struct {
+	middlewares []Middleware
+}
+
+// NewChain creates a chain of the given middleware.
+func NewChain(middlewares ...Middleware) Chain {
+	return Chain{}.Append(middlewares...)
+}
+
+// Append returns a new chain with the middleware added after the existing ones.
+func (c Chain) Append(middlewares ...Middleware) Chain {
+	combined := make([]Middleware, 0, len(c.middlewares)+len(middlewares))
+	combined = append(combined, c.middlewares...)
+	for _, m := range middlewares {
+		if m != nil {
+			combined = append(combined, m)
+		}
+	}
+	return Chain{middlewares: combined}
+}
+
+// Then wraps h in the chain's middleware.
+func (c Chain) Then(h HttpRequestHandlerFunc) HttpRequestHandlerFunc {
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		h = c.middlewares[i](h)
+	}
+	return h
+}
+
+// Handler wraps h in the chain and passes it to HttpRequestHandler. Request logging and
+// panic recovery are done by HttpRequestHandler, so they always wrap the whole chain and
+// see the errors returned by middleware as well as by h.
+func (c Chain) Handler(h HttpRequestHandlerFunc, logger IrisLogger, opts ...HandlerOption) http.HandlerFunc {
+	return HttpRequestHandler(c.Then(h), logger, opts...)
+}
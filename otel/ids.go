@@ -0,0 +1,101 @@
+package otel
+
+import (
+	ctxpkg "context"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type spanIdsKey struct{}
+
+// spanIds are the ids a span should be created with. Zero ids are left to be random.
+type spanIds struct {
+	traceID trace.TraceID
+	spanID  trace.SpanID
+}
+
+// traceIDFrom returns the trace id of a correlation id: the id itself if it is a UUID, as
+// it is when set by HttpRequestHandler, and a hash of it otherwise.
+func traceIDFrom(correlationId string) trace.TraceID {
+	if correlationId == "" {
+		return trace.TraceID{}
+	}
+	if id, err := uuid.Parse(correlationId); err == nil {
+		return trace.TraceID(id)
+	}
+	var traceID trace.TraceID
+	hash := fnv.New128a()
+	hash.Write([]byte(correlationId))
+	copy(traceID[:], hash.Sum(nil))
+	return traceID
+}
+
+// spanIDFrom returns the span id of a SpanId or ParentId of an IrisLogContext.
+func spanIDFrom(id string) trace.SpanID {
+	var spanID trace.SpanID
+	if id == "" {
+		return spanID
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(id))
+	copy(spanID[:], hash.Sum(nil))
+	return spanID
+}
+
+// traceContext returns the context to start a span with, so that it gets the trace id of
+// the correlation and the id spanId, and is a child of parentId. A span without a parent
+// is the root of the trace.
+func traceContext(correlationId string, spanId string, parentId string) ctxpkg.Context {
+	ids := spanIds{traceID: traceIDFrom(correlationId), spanID: spanIDFrom(spanId)}
+	ctx := ctxpkg.WithValue(ctxpkg.Background(), spanIdsKey{}, ids)
+	if !ids.traceID.IsValid() || parentId == "" {
+		return ctx
+	}
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    ids.traceID,
+		SpanID:     spanIDFrom(parentId),
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	return trace.ContextWithRemoteSpanContext(ctx, parent)
+}
+
+// idGenerator gives spans the ids requested by traceContext, and random ids otherwise.
+type idGenerator struct {
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// IDGenerator returns the id generator to create a TracerProvider with, for spans logged by
+// NewLogger to get the ids of their IrisLogContext. Spans logged within a request then
+// nest under it, as they do in Application Insights. NewOTLPLogger uses it.
+func IDGenerator() sdktrace.IDGenerator {
+	return &idGenerator{random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (g *idGenerator) NewIDs(ctx ctxpkg.Context) (trace.TraceID, trace.SpanID) {
+	ids, _ := ctx.Value(spanIdsKey{}).(spanIds)
+	if !ids.traceID.IsValid() {
+		g.mu.Lock()
+		g.random.Read(ids.traceID[:])
+		g.mu.Unlock()
+	}
+	return ids.traceID, g.NewSpanID(ctx, ids.traceID)
+}
+
+func (g *idGenerator) NewSpanID(ctx ctxpkg.Context, traceID trace.TraceID) trace.SpanID {
+	ids, _ := ctx.Value(spanIdsKey{}).(spanIds)
+	if ids.spanID.IsValid() {
+		return ids.spanID
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.random.Read(ids.spanID[:])
+	return ids.spanID
+}
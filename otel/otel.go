@@ -0,0 +1,395 @@
+// Package otel is an IrisLogger that emits OpenTelemetry spans and metrics. It is a module
+// of its own, so that services that only use Application Insights don't depend on the
+// OpenTelemetry SDK.
+package otel
+
+import (
+	ctxpkg "context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johanohlin/goservice"
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Settings configures NewLogger. Zero fields are replaced by the defaults noted on them.
+type Settings struct {
+	// ServiceName names the tracer and meter.
+	ServiceName string
+	// TracerProvider creates the spans. Defaults to the global provider. Create it with
+	// `sdktrace.WithIDGenerator(IDGenerator())`, so that spans get the ids of their
+	// IrisLogContext and nest; otherwise each span gets random ids.
+	TracerProvider trace.TracerProvider
+	// MeterProvider creates the metric instruments. Defaults to the global provider.
+	MeterProvider metric.MeterProvider
+}
+
+// otelLogger is an IrisLogger that emits OpenTelemetry spans and metrics:
+//   - Request and Dependency are server and client spans, with the given duration.
+//   - Availability is an internal span.
+//   - Info, Warning and Error are events of the span of their SpanId, added when that
+//     request or operation ends. Errors are recorded with the attributes of their IrisError.
+//     Events without a SpanId, with too many spans pending, or still held on Close, get an
+//     internal span named after the event code instead.
+//   - Metric is recorded on a histogram, with the Properties of the log context as
+//     attributes but not its ids, which would make a series per request. MetricSummary
+//     records a gauge's value on a gauge, and other summaries on `.count` and `.sum`
+//     counters, as OpenTelemetry can't take values that were aggregated elsewhere.
+//
+// Spans are linked like Application Insights telemetry: the trace id is the CorrelationId,
+// a request's span id is its SpanId and its parent its ParentId, a dependency's span id is
+// its DependencyId, if set, and everything but requests is a child of the SpanId. See
+// IDGenerator.
+type otelLogger struct {
+	tracer trace.Tracer
+	meter  metric.Meter
+	// shutdown flushes and stops the providers, if they were created by NewOTLPLogger.
+	shutdown func(ctx ctxpkg.Context) error
+
+	mu         sync.Mutex
+	histograms map[string]metric.Float64Histogram
+	counters   map[string]metric.Float64Counter
+	gauges     map[string]metric.Float64Gauge
+	// pending are the events waiting for the span of their SpanId to end.
+	pending map[string][]pendingEvent
+}
+
+// pendingEvent is an event logged within a span that hasn't ended yet.
+type pendingEvent struct {
+	code       string
+	severity   string
+	message    string
+	err        error
+	at         time.Time
+	attributes []attribute.KeyValue
+	context    goservice.IrisLogContext
+}
+
+// maxPendingSpans limits the spans whose events are held until they end, in case some
+// never do.
+const maxPendingSpans = 10000
+
+// NewLogger returns an IrisLogger that emits OpenTelemetry spans and metrics through the
+// providers of the settings.
+func NewLogger(settings Settings) goservice.IrisLogger {
+	if settings.TracerProvider == nil {
+		settings.TracerProvider = otelapi.GetTracerProvider()
+	}
+	if settings.MeterProvider == nil {
+		settings.MeterProvider = otelapi.GetMeterProvider()
+	}
+	return &otelLogger{
+		tracer:     settings.TracerProvider.Tracer(settings.ServiceName),
+		meter:      settings.MeterProvider.Meter(settings.ServiceName),
+		histograms: map[string]metric.Float64Histogram{},
+		counters:   map[string]metric.Float64Counter{},
+		gauges:     map[string]metric.Float64Gauge{},
+		pending:    map[string][]pendingEvent{},
+	}
+}
+
+// NewOTLPLogger returns an IrisLogger that exports spans and metrics with OTLP over HTTP to
+// a collector at endpoint, such as `localhost:4318`. The connection is not encrypted, as
+// the collector is expected to run alongside the service.
+func NewOTLPLogger(ctx ctxpkg.Context, endpoint string, serviceName string) (goservice.IrisLogger, error) {
+	traceExporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpoint(endpoint), otlpmetrichttp.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP metric exporter: %w", err)
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", serviceName))
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithIDGenerator(IDGenerator()),
+	)
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)), sdkmetric.WithResource(res))
+
+	logger := NewLogger(Settings{
+		ServiceName:    serviceName,
+		TracerProvider: tracerProvider,
+		MeterProvider:  meterProvider,
+	}).(*otelLogger)
+	logger.shutdown = func(ctx ctxpkg.Context) error {
+		traceErr := tracerProvider.Shutdown(ctx)
+		if err := meterProvider.Shutdown(ctx); err != nil {
+			return err
+		}
+		return traceErr
+	}
+	return logger, nil
+}
+
+// contextAttributes returns the attributes of the log context, followed by those given.
+func contextAttributes(context goservice.IrisLogContext, data map[string]string) []attribute.KeyValue {
+	attributes := make([]attribute.KeyValue, 0, 3+len(context.Properties)+len(data))
+	if context.CorrelationId != "" {
+		attributes = append(attributes, attribute.String("iris.correlation_id", context.CorrelationId))
+	}
+	if context.UserId != "" {
+		attributes = append(attributes, attribute.String("enduser.id", context.UserId))
+	}
+	if context.OperationName != "" {
+		attributes = append(attributes, attribute.String("iris.operation_name", context.OperationName))
+	}
+	for k, v := range context.Properties {
+		if _, ok := data[k]; !ok {
+			attributes = append(attributes, attribute.String(k, v))
+		}
+	}
+	for k, v := range data {
+		attributes = append(attributes, attribute.String(k, v))
+	}
+	return attributes
+}
+
+// metricAttributes returns the attributes of a metric: only the properties of the log
+// context, as ids would make a series per request.
+func metricAttributes(context goservice.IrisLogContext) []attribute.KeyValue {
+	attributes := make([]attribute.KeyValue, 0, len(context.Properties))
+	for k, v := range context.Properties {
+		attributes = append(attributes, attribute.String(k, v))
+	}
+	return attributes
+}
+
+// span records a span that ended now and lasted duration, with the id spanId, or a random
+// one if it is empty, as a child of parentId.
+func (log *otelLogger) span(name string, kind trace.SpanKind, duration time.Duration, context goservice.IrisLogContext, spanId string, parentId string, attributes []attribute.KeyValue) trace.Span {
+	end := time.Now()
+	_, span := log.tracer.Start(traceContext(context.CorrelationId, spanId, parentId), name,
+		trace.WithSpanKind(kind),
+		trace.WithTimestamp(end.Add(-duration)),
+		trace.WithAttributes(attributes...),
+	)
+	return span
+}
+
+func (log *otelLogger) histogram(name string) metric.Float64Histogram {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	histogram, ok := log.histograms[name]
+	if !ok {
+		// On error the returned instrument does nothing, which is all that can be done.
+		histogram, _ = log.meter.Float64Histogram(name)
+		log.histograms[name] = histogram
+	}
+	return histogram
+}
+
+func (log *otelLogger) counter(name string) metric.Float64Counter {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	counter, ok := log.counters[name]
+	if !ok {
+		counter, _ = log.meter.Float64Counter(name)
+		log.counters[name] = counter
+	}
+	return counter
+}
+
+func (log *otelLogger) gauge(name string) metric.Float64Gauge {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	gauge, ok := log.gauges[name]
+	if !ok {
+		gauge, _ = log.meter.Float64Gauge(name)
+		log.gauges[name] = gauge
+	}
+	return gauge
+}
+
+func (log *otelLogger) Metric(name string, value float64, context goservice.IrisLogContext) {
+	log.histogram(name).Record(ctxpkg.Background(), value, metric.WithAttributes(metricAttributes(context)...))
+}
+
+func (log *otelLogger) MetricSummary(name string, summary goservice.MetricSummary, context goservice.IrisLogContext) {
+	attributes := metric.WithAttributes(metricAttributes(context)...)
+	if summary.Kind == goservice.METRIC_GAUGE {
+		log.gauge(name).Record(ctxpkg.Background(), summary.Sum, attributes)
+		return
+	}
+	log.counter(name+".count").Add(ctxpkg.Background(), float64(summary.Count), attributes)
+	log.counter(name+".sum").Add(ctxpkg.Background(), summary.Sum, attributes)
+}
+
+// event holds an event until the span of its SpanId ends, or records it on a span of its
+// own if there is none.
+func (log *otelLogger) event(event pendingEvent) {
+	event.at = time.Now()
+	event.attributes = append(event.attributes,
+		attribute.String("event_code", event.code),
+		attribute.String("severity", event.severity),
+		attribute.String("message", event.message),
+	)
+	if !log.hold(event) {
+		log.eventSpan(event)
+	}
+}
+
+// hold keeps the event until the span of its SpanId ends, and returns false if it can't.
+func (log *otelLogger) hold(event pendingEvent) bool {
+	spanId := event.context.SpanId
+	if spanId == "" {
+		return false
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if _, ok := log.pending[spanId]; !ok && len(log.pending) >= maxPendingSpans {
+		return false
+	}
+	log.pending[spanId] = append(log.pending[spanId], event)
+	return true
+}
+
+// eventSpan records the event on an internal span named after its code.
+func (log *otelLogger) eventSpan(event pendingEvent) {
+	span := log.span(event.code, trace.SpanKindInternal, 0, event.context, "", event.context.SpanId, nil)
+	addEvent(span, event)
+	if event.severity == "error" {
+		span.SetStatus(codes.Error, event.message)
+	}
+	span.End()
+}
+
+// addEvent adds an event to the span, as an exception if it has an error.
+func addEvent(span trace.Span, event pendingEvent) {
+	options := []trace.EventOption{trace.WithTimestamp(event.at), trace.WithAttributes(event.attributes...)}
+	if event.err != nil {
+		span.RecordError(event.err, options...)
+		return
+	}
+	span.AddEvent(event.message, options...)
+}
+
+// addPending adds the events held for the span with the id spanId.
+func (log *otelLogger) addPending(span trace.Span, spanId string) {
+	if spanId == "" {
+		return
+	}
+	log.mu.Lock()
+	events := log.pending[spanId]
+	delete(log.pending, spanId)
+	log.mu.Unlock()
+	for _, event := range events {
+		addEvent(span, event)
+	}
+}
+
+func (log *otelLogger) Info(code string, message string, data map[string]string, context goservice.IrisLogContext) {
+	log.event(pendingEvent{code: code, severity: "info", message: message, attributes: contextAttributes(context, data), context: context})
+}
+
+func (log *otelLogger) Warning(code string, message string, data map[string]string, context goservice.IrisLogContext) {
+	log.event(pendingEvent{code: code, severity: "warning", message: message, attributes: contextAttributes(context, data), context: context})
+}
+
+func (log *otelLogger) Error(code string, err interface{}, data map[string]string, context goservice.IrisLogContext) {
+	event := pendingEvent{code: code, severity: "error", message: fmt.Sprint(err), attributes: contextAttributes(context, data), context: context}
+	if e, ok := err.(error); ok {
+		event.err = e
+		event.message = e.Error()
+		if iriserr, ok := goservice.As(e); ok {
+			event.attributes = append(event.attributes, irisErrorAttributes(iriserr)...)
+		}
+	}
+	log.event(event)
+}
+
+// irisErrorAttributes returns the attributes describing an IrisError.
+func irisErrorAttributes(err *goservice.IrisError) []attribute.KeyValue {
+	attributes := []attribute.KeyValue{
+		attribute.String("iris.type_code", err.TypeCode),
+		attribute.String("iris.code", err.Code),
+		attribute.String("iris.message", err.Message),
+		attribute.Bool("iris.retryable", err.Retryable()),
+	}
+	for k, v := range err.Params {
+		attributes = append(attributes, attribute.String("iris.param."+k, v))
+	}
+	if len(err.Errors) > 0 {
+		attributes = append(attributes, attribute.Int("iris.error_count", len(err.Errors)))
+		if bytes, marshalErr := json.Marshal(err.Errors); marshalErr == nil {
+			attributes = append(attributes, attribute.String("iris.errors", string(bytes)))
+		}
+	}
+	return attributes
+}
+
+func (log *otelLogger) Request(method string, url string, duration time.Duration, responseCode string, clientAddress string, context goservice.IrisLogContext) {
+	name := context.OperationName
+	if name == "" {
+		name = method
+	}
+	attributes := append(contextAttributes(context, nil),
+		attribute.String("http.method", method),
+		attribute.String("http.url", url),
+		attribute.String("http.status_code", responseCode),
+	)
+	if clientAddress != "" {
+		attributes = append(attributes, attribute.String("client.address", clientAddress))
+	}
+	span := log.span(name, trace.SpanKindServer, duration, context, context.SpanId, context.ParentId, attributes)
+	log.addPending(span, context.SpanId)
+	if status, err := strconv.Atoi(responseCode); err == nil && status >= 500 {
+		span.SetStatus(codes.Error, responseCode)
+	}
+	span.End(trace.WithTimestamp(time.Now()))
+}
+
+func (log *otelLogger) Dependency(name string, dependencyType string, target string, duration time.Duration, success bool, resultCode string, context goservice.IrisLogContext) {
+	attributes := append(contextAttributes(context, nil),
+		attribute.String("dependency.type", dependencyType),
+		attribute.String("dependency.target", target),
+		attribute.String("dependency.result_code", resultCode),
+	)
+	span := log.span(name, trace.SpanKindClient, duration, context, context.DependencyId, context.SpanId, attributes)
+	log.addPending(span, context.DependencyId)
+	if !success {
+		span.SetStatus(codes.Error, resultCode)
+	}
+	span.End(trace.WithTimestamp(time.Now()))
+}
+
+func (log *otelLogger) Availability(name string, duration time.Duration, success bool, message string, context goservice.IrisLogContext) {
+	attributes := append(contextAttributes(context, nil), attribute.String("message", message))
+	span := log.span(name, trace.SpanKindInternal, duration, context, "", context.SpanId, attributes)
+	if !success {
+		span.SetStatus(codes.Error, message)
+	}
+	span.End(trace.WithTimestamp(time.Now()))
+}
+
+func (log *otelLogger) Close(timeout time.Duration) {
+	// Events whose span never ended get spans of their own, so that they aren't lost.
+	log.mu.Lock()
+	pending := log.pending
+	log.pending = map[string][]pendingEvent{}
+	log.mu.Unlock()
+	for _, events := range pending {
+		for _, event := range events {
+			log.eventSpan(event)
+		}
+	}
+	if log.shutdown == nil {
+		return
+	}
+	ctx, cancel := ctxpkg.WithTimeout(ctxpkg.Background(), timeout)
+	defer cancel()
+	log.shutdown(ctx)
+}
@@ -0,0 +1,213 @@
+package otel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johanohlin/goservice"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestLogger() (goservice.IrisLogger, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder), sdktrace.WithIDGenerator(IDGenerator()))
+	return NewLogger(Settings{ServiceName: "test", TracerProvider: provider}), recorder
+}
+
+func spanNamed(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("no span named %s", name)
+	return nil
+}
+
+func TestSpansNestLikeTheLogContext(t *testing.T) {
+	logger, recorder := newTestLogger()
+	request := goservice.IrisLogContext{
+		CorrelationId: uuid.New().String(),
+		SpanId:        uuid.New().String(),
+	}
+	operation := request
+	operation.SpanId, operation.ParentId = uuid.New().String(), request.SpanId
+
+	logger.Info("loading_user", "loading user", nil, operation)
+	// The operation is logged as a dependency of the request, as Span.End does.
+	dependency := request
+	dependency.DependencyId = operation.SpanId
+	logger.(goservice.DependencyLogger).Dependency("query", "SQL", "db", time.Millisecond, true, "", dependency)
+	logger.(goservice.DependencyLogger).Dependency("call", "HTTP", "billing", time.Millisecond, true, "200", request)
+	logger.Request("GET", "https://example.com/users/1", time.Second, "200", "", request)
+
+	requestSpan := spanNamed(t, recorder, "GET")
+	querySpan := spanNamed(t, recorder, "query")
+	callSpan := spanNamed(t, recorder, "call")
+
+	wantTrace := trace.TraceID(uuid.MustParse(request.CorrelationId))
+	for _, span := range []sdktrace.ReadOnlySpan{requestSpan, querySpan, callSpan} {
+		if span.SpanContext().TraceID() != wantTrace {
+			t.Errorf("span %s has trace %s, want the correlation id", span.Name(), span.SpanContext().TraceID())
+		}
+	}
+	if requestSpan.Parent().IsValid() {
+		t.Errorf("the request has parent %s, want none", requestSpan.Parent().SpanID())
+	}
+	if requestSpan.SpanContext().SpanID() != spanIDFrom(request.SpanId) {
+		t.Error("the request span does not have the id of its SpanId")
+	}
+	if querySpan.Parent().SpanID() != requestSpan.SpanContext().SpanID() {
+		t.Error("the operation is not a child of the request")
+	}
+	if querySpan.SpanContext().SpanID() != spanIDFrom(operation.SpanId) {
+		t.Error("the operation span does not have the id of its DependencyId")
+	}
+	if callSpan.Parent().SpanID() != requestSpan.SpanContext().SpanID() {
+		t.Error("the dependency is not a child of the request")
+	}
+	if callSpan.SpanContext().SpanID() == requestSpan.SpanContext().SpanID() {
+		t.Error("the dependency has the id of the request")
+	}
+	if events := querySpan.Events(); len(events) != 1 || events[0].Name != "loading user" {
+		t.Errorf("got events %v on the operation, want the event logged within it", events)
+	}
+	if len(recorder.Ended()) != 3 {
+		t.Errorf("got %d spans, want no span for the event", len(recorder.Ended()))
+	}
+}
+
+func TestSpansWithoutCorrelationGetRandomIds(t *testing.T) {
+	logger, recorder := newTestLogger()
+	logger.Info("started", "started", nil, goservice.IrisLogContext{})
+	logger.Info("started", "started", nil, goservice.IrisLogContext{})
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	if !spans[0].SpanContext().IsValid() || spans[0].SpanContext().TraceID() == spans[1].SpanContext().TraceID() {
+		t.Error("spans without a correlation id should get distinct random traces")
+	}
+}
+
+// newMeteredLogger returns a logger whose metrics are read with the returned reader.
+func newMeteredLogger() (goservice.IrisLogger, *sdkmetric.ManualReader) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	return NewLogger(Settings{ServiceName: "test", MeterProvider: provider}), reader
+}
+
+func collectMetric(t *testing.T, reader *sdkmetric.ManualReader, name string) metricdata.Aggregation {
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatal(err)
+	}
+	for _, scope := range collected.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name == name {
+				return m.Data
+			}
+		}
+	}
+	t.Fatalf("no metric named %s", name)
+	return nil
+}
+
+func TestMetricSummaries(t *testing.T) {
+	logger, reader := newMeteredLogger()
+	summaries := logger.(goservice.MetricSummaryLogger)
+	summaries.MetricSummary("queue_length", goservice.MetricSummary{Kind: goservice.METRIC_GAUGE, Count: 1, Sum: 7, Min: 7, Max: 7}, goservice.IrisLogContext{})
+	summaries.MetricSummary("queue_length", goservice.MetricSummary{Kind: goservice.METRIC_GAUGE, Count: 1, Sum: 3, Min: 3, Max: 3}, goservice.IrisLogContext{})
+	summaries.MetricSummary("requests", goservice.MetricSummary{Kind: goservice.METRIC_COUNTER, Count: 2, Sum: 5}, goservice.IrisLogContext{})
+	summaries.MetricSummary("requests", goservice.MetricSummary{Kind: goservice.METRIC_COUNTER, Count: 1, Sum: 4}, goservice.IrisLogContext{})
+
+	gauge, ok := collectMetric(t, reader, "queue_length").(metricdata.Gauge[float64])
+	if !ok || len(gauge.DataPoints) != 1 || gauge.DataPoints[0].Value != 3 {
+		t.Errorf("got %+v, want a gauge of the last value", gauge)
+	}
+	sum, ok := collectMetric(t, reader, "requests.sum").(metricdata.Sum[float64])
+	if !ok || len(sum.DataPoints) != 1 || sum.DataPoints[0].Value != 9 {
+		t.Errorf("got %+v, want a sum of 9", sum)
+	}
+	count, ok := collectMetric(t, reader, "requests.count").(metricdata.Sum[float64])
+	if !ok || len(count.DataPoints) != 1 || count.DataPoints[0].Value != 3 {
+		t.Errorf("got %+v, want a count of 3", count)
+	}
+}
+
+func TestErrorsAreRecordedOnTheirSpan(t *testing.T) {
+	logger, recorder := newTestLogger()
+	request := goservice.IrisLogContext{CorrelationId: uuid.New().String(), SpanId: uuid.New().String()}
+	logger.Warning("slow_query", "query took 2s", map[string]string{"table": "users"}, request)
+	logger.Error("loading_user", goservice.NotFound("user_not_found", "user not found", nil), nil, request)
+	logger.Request("GET", "https://example.com/users/1", time.Second, "404", "", request)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want only the request", len(spans))
+	}
+	events := spans[0].Events()
+	if len(events) != 2 || events[0].Name != "query took 2s" || events[1].Name != "exception" {
+		t.Fatalf("got events %v, want the warning and the exception", events)
+	}
+	attributes := attribute.NewSet(events[1].Attributes...)
+	if typeCode, _ := attributes.Value("iris.type_code"); typeCode.AsString() != "not_found" {
+		t.Errorf("got attributes %v, want those of the IrisError", events[1].Attributes)
+	}
+	if severity, _ := attributes.Value("severity"); severity.AsString() != "error" {
+		t.Errorf("got attributes %v, want the severity", events[1].Attributes)
+	}
+}
+
+func TestEventsWithoutTheirSpanAreNotLost(t *testing.T) {
+	logger, recorder := newTestLogger()
+	request := goservice.IrisLogContext{CorrelationId: uuid.New().String(), SpanId: uuid.New().String()}
+	logger.Error("failed", "something failed", nil, request)
+	if len(recorder.Ended()) != 0 {
+		t.Fatal("the event was recorded before its span ended")
+	}
+
+	logger.(goservice.ClosableLogger).Close(time.Second)
+	span := spanNamed(t, recorder, "failed")
+	if span.Parent().SpanID() != spanIDFrom(request.SpanId) {
+		t.Error("the event span is not a child of its SpanId")
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("got status %v, want an error", span.Status())
+	}
+	if events := span.Events(); len(events) != 1 || events[0].Name != "something failed" {
+		t.Errorf("got events %v", events)
+	}
+}
+
+func TestMetricsOnlyHaveTheContextProperties(t *testing.T) {
+	logger, reader := newMeteredLogger()
+	context := goservice.IrisLogContext{
+		CorrelationId: uuid.New().String(),
+		SpanId:        uuid.New().String(),
+		UserId:        "user-1",
+		OperationName: "GET /users",
+		Properties:    map[string]string{"route": "/users"},
+	}
+	logger.Metric("latency", 0.5, context)
+	context.CorrelationId, context.UserId = uuid.New().String(), "user-2"
+	logger.Metric("latency", 0.25, context)
+
+	histogram, ok := collectMetric(t, reader, "latency").(metricdata.Histogram[float64])
+	if !ok || len(histogram.DataPoints) != 1 {
+		t.Fatalf("got %+v, want one series", histogram)
+	}
+	want := attribute.NewSet(attribute.String("route", "/users"))
+	if point := histogram.DataPoints[0]; !point.Attributes.Equals(&want) || point.Count != 2 {
+		t.Errorf("got %v with %d values, want only the properties", point.Attributes.ToSlice(), point.Count)
+	}
+}
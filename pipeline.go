@@ -0,0 +1,566 @@
+package goservice
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Drop policies of a TelemetryPipeline, applied when its queue is full.
+const (
+	// DROP_OLDEST drops the oldest queued item to make room for the new one.
+	DROP_OLDEST = "drop_oldest"
+	// DROP_BY_SEVERITY drops the oldest of the least severe queued items, if it is no more
+	// severe than the new item, and drops the new item otherwise. Metrics are the least
+	// severe, then traces by level, requests and dependencies, and exceptions.
+	DROP_BY_SEVERITY = "drop_by_severity"
+	// BLOCK makes the logging call wait for room, up to BlockTimeout, and then drops the
+	// new item.
+	BLOCK = "block"
+)
+
+// PipelineSettings configures a TelemetryPipeline. Zero fields are replaced by the
+// defaults noted on them.
+type PipelineSettings struct {
+	// Capacity is the number of items the queue holds. Defaults to 10000.
+	Capacity int
+	// DropPolicy is what happens when the queue is full. Defaults to DROP_OLDEST.
+	DropPolicy string
+	// BlockTimeout is how long a logging call waits for room with the BLOCK policy.
+	// Defaults to 100ms.
+	BlockTimeout time.Duration
+	// BatchInterval is the longest an item waits to be sent with others, unless a full
+	// batch is queued first. Defaults to 2s.
+	BatchInterval time.Duration
+	// SpoolDir, if set, is a directory where the items that don't fit in the queue are
+	// written instead of being dropped. Batches that fail to be sent are written to the
+	// spool too, rather than put back in the queue. Spooled items are sent before the
+	// queued ones, oldest file first, so that they are replayed in order once the endpoint
+	// can be reached again, including by the next process to use the directory. While the
+	// spool is not empty, closing the logger spools the queue rather than send it. See
+	// InspectSpool and DrainSpool.
+	SpoolDir string
+	// SpoolMaxBytes caps the size of the spool directory. Items that don't fit are
+	// dropped. Defaults to 100MB.
+	SpoolMaxBytes int64
+	// SpoolMaxAge is how long items are kept in the spool before being dropped. Defaults
+	// to 48h, as Application Insights doesn't accept older telemetry.
+	SpoolMaxAge time.Duration
+	// Diagnostics, if set, receives a message for each batch sent and each failure.
+	Diagnostics func(message string)
+	// SelfMetricsInterval, if set, is the interval at which the logger reports metrics of
+	// the pipeline itself: the queue depth, and the items dropped, spooled, accepted and
+	// rejected since the last report.
+	SelfMetricsInterval time.Duration
+}
+
+// Names of the metrics reported with PipelineSettings.SelfMetricsInterval.
+const (
+	METRIC_TELEMETRY_QUEUE_DEPTH = "goservice.telemetry.queue_depth"
+	METRIC_TELEMETRY_DROPPED     = "goservice.telemetry.dropped"
+	METRIC_TELEMETRY_SPOOLED     = "goservice.telemetry.spooled"
+	METRIC_TELEMETRY_ACCEPTED    = "goservice.telemetry.accepted"
+	METRIC_TELEMETRY_REJECTED    = "goservice.telemetry.rejected"
+)
+
+// TelemetryPipeline is a bounded queue between a logger and where its telemetry is sent,
+// so that logging never uses unbounded memory, and only blocks if asked to. NewLogger
+// creates one with the default settings, unless given one with WithPipeline. The logger
+// sends the telemetry itself rather than through the Application Insights channel, so
+// that the results can be seen in Stats.
+type TelemetryPipeline struct {
+	settings PipelineSettings
+	spool    *spool
+	sink     *httpSink
+	logger   IrisLogger
+	wake     chan struct{}
+	full     chan struct{}
+	closing  chan struct{}
+	done     chan struct{}
+
+	// backoff is the wait after the last failed send, and retryAt when sending resumes.
+	// They are only used by the goroutine sending the items.
+	backoff time.Duration
+	retryAt time.Time
+
+	mu      sync.Mutex
+	queue   []pipelineItem
+	closed  bool
+	started bool
+	// changed is closed and replaced whenever items leave the queue, to wake blocked calls.
+	changed chan struct{}
+
+	dropped int64
+	spooled int64
+}
+
+// PipelineStats are counters of a TelemetryPipeline, since it was created.
+type PipelineStats struct {
+	// Depth is the number of items queued.
+	Depth int
+	// Dropped is the number of items dropped, for lack of room or for being too old.
+	Dropped int64
+	// Spooled is the number of items written to the spool directory.
+	Spooled int64
+	// Accepted is the number of items the endpoint accepted.
+	Accepted int64
+	// Rejected is the number of items the endpoint refused, and that were not retried.
+	Rejected int64
+	// Throttled is the number of times the endpoint asked for sending to slow down.
+	Throttled int64
+	// LastError is the last failure to send, and LastErrorAt when it happened.
+	LastError   string
+	LastErrorAt time.Time
+}
+
+type pipelineItem struct {
+	Severity contracts.SeverityLevel `json:"severity"`
+	Envelope *contracts.Envelope     `json:"envelope"`
+}
+
+// pipelineBatchSize is the most items a pipeline sends to its sink at once.
+const pipelineBatchSize = 500
+
+// Bounds of the wait after a failed send, which doubles with each failure in a row.
+const (
+	pipelineMinBackoff = time.Second
+	pipelineMaxBackoff = 5 * time.Minute
+)
+
+// NewTelemetryPipeline creates a pipeline. It starts sending once given to NewLogger.
+func NewTelemetryPipeline(settings PipelineSettings) *TelemetryPipeline {
+	if settings.Capacity <= 0 {
+		settings.Capacity = 10000
+	}
+	if settings.DropPolicy == "" {
+		settings.DropPolicy = DROP_OLDEST
+	}
+	if settings.BlockTimeout <= 0 {
+		settings.BlockTimeout = 100 * time.Millisecond
+	}
+	if settings.BatchInterval <= 0 {
+		settings.BatchInterval = 2 * time.Second
+	}
+	if settings.SpoolMaxBytes <= 0 {
+		settings.SpoolMaxBytes = 100 << 20
+	}
+	if settings.SpoolMaxAge <= 0 {
+		settings.SpoolMaxAge = 48 * time.Hour
+	}
+	p := &TelemetryPipeline{
+		settings: settings,
+		wake:     make(chan struct{}, 1),
+		full:     make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		changed:  make(chan struct{}),
+	}
+	if settings.SpoolDir != "" {
+		p.spool = newSpool(settings.SpoolDir, settings.SpoolMaxBytes, settings.SpoolMaxAge)
+	}
+	return p
+}
+
+// Stats returns the pipeline's counters.
+func (p *TelemetryPipeline) Stats() PipelineStats {
+	p.mu.Lock()
+	depth := len(p.queue)
+	p.mu.Unlock()
+	stats := PipelineStats{
+		Depth:   depth,
+		Dropped: atomic.LoadInt64(&p.dropped),
+		Spooled: atomic.LoadInt64(&p.spooled),
+	}
+	if p.spool != nil {
+		stats.Dropped += atomic.LoadInt64(&p.spool.expired)
+	}
+	if sink := p.currentSink(); sink != nil {
+		sink.addStats(&stats)
+	}
+	return stats
+}
+
+func (p *TelemetryPipeline) currentSink() *httpSink {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sink
+}
+
+// diagnose sends a message to the Diagnostics function, if there is one.
+func (p *TelemetryPipeline) diagnose(format string, args ...interface{}) {
+	if p.settings.Diagnostics != nil {
+		p.settings.Diagnostics(fmt.Sprintf(format, args...))
+	}
+}
+
+// start sends the queued items to sink in the background, and reports the pipeline's
+// metrics to logger if asked to.
+func (p *TelemetryPipeline) start(sink *httpSink, logger IrisLogger) {
+	p.mu.Lock()
+	if p.started {
+		p.mu.Unlock()
+		panic("goservice: TelemetryPipeline given to more than one logger")
+	}
+	p.started = true
+	p.sink = sink
+	p.logger = logger
+	p.mu.Unlock()
+	go p.run()
+	if p.settings.SelfMetricsInterval > 0 {
+		go p.reportMetrics()
+	}
+}
+
+// reportMetrics reports the pipeline's metrics at every interval until it is closed.
+func (p *TelemetryPipeline) reportMetrics() {
+	ticker := currentClock.NewTicker(p.settings.SelfMetricsInterval)
+	defer ticker.Stop()
+	last := PipelineStats{}
+	context := IrisLogContext{}
+	for {
+		select {
+		case <-p.closing:
+			return
+		case <-ticker.C():
+		}
+		stats := p.Stats()
+		p.logger.Metric(METRIC_TELEMETRY_QUEUE_DEPTH, float64(stats.Depth), context)
+		p.logger.Metric(METRIC_TELEMETRY_DROPPED, float64(stats.Dropped-last.Dropped), context)
+		p.logger.Metric(METRIC_TELEMETRY_SPOOLED, float64(stats.Spooled-last.Spooled), context)
+		p.logger.Metric(METRIC_TELEMETRY_ACCEPTED, float64(stats.Accepted-last.Accepted), context)
+		p.logger.Metric(METRIC_TELEMETRY_REJECTED, float64(stats.Rejected-last.Rejected), context)
+		last = stats
+	}
+}
+
+// add queues an item, applying the drop policy if the queue is full.
+func (p *TelemetryPipeline) add(item pipelineItem) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.drop(item)
+		return
+	}
+	if len(p.queue) >= p.settings.Capacity {
+		switch p.settings.DropPolicy {
+		case BLOCK:
+			if !p.waitForRoom() {
+				p.mu.Unlock()
+				p.drop(item)
+				return
+			}
+		case DROP_BY_SEVERITY:
+			i := p.leastSevere()
+			if p.queue[i].Severity > item.Severity {
+				p.mu.Unlock()
+				p.drop(item)
+				return
+			}
+			dropped := p.queue[i]
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			defer p.drop(dropped)
+		default:
+			dropped := p.queue[0]
+			p.queue = p.queue[1:]
+			defer p.drop(dropped)
+		}
+	}
+	p.queue = append(p.queue, item)
+	full := len(p.queue) >= pipelineBatchSize
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	if full {
+		select {
+		case p.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// waitForRoom waits until the queue has room, or the block timeout passes. It is called
+// and returns with p.mu held.
+func (p *TelemetryPipeline) waitForRoom() bool {
+	timer := currentClock.NewTimer(p.settings.BlockTimeout)
+	defer timer.Stop()
+	for len(p.queue) >= p.settings.Capacity && !p.closed {
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+			p.mu.Lock()
+		case <-timer.C():
+			p.mu.Lock()
+			return len(p.queue) < p.settings.Capacity && !p.closed
+		}
+	}
+	return !p.closed
+}
+
+// leastSevere returns the index of the oldest of the least severe queued items.
+func (p *TelemetryPipeline) leastSevere() int {
+	least := 0
+	for i, item := range p.queue {
+		if item.Severity < p.queue[least].Severity {
+			least = i
+		}
+	}
+	return least
+}
+
+// drop spools the item if there is a spool with room, and counts it as dropped otherwise.
+func (p *TelemetryPipeline) drop(item pipelineItem) {
+	if p.spool != nil && p.spool.write(item) == nil {
+		atomic.AddInt64(&p.spooled, 1)
+		return
+	}
+	atomic.AddInt64(&p.dropped, 1)
+}
+
+// take removes up to max items from the front of the queue.
+func (p *TelemetryPipeline) take(max int) []pipelineItem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.queue)
+	if n > max {
+		n = max
+	}
+	if n == 0 {
+		return nil
+	}
+	items := make([]pipelineItem, n)
+	copy(items, p.queue)
+	p.queue = p.queue[n:]
+	close(p.changed)
+	p.changed = make(chan struct{})
+	return items
+}
+
+func (p *TelemetryPipeline) run() {
+	defer close(p.done)
+	for {
+		p.mu.Lock()
+		closed := p.closed
+		p.mu.Unlock()
+		if wait := p.retryAt.Sub(currentClock.Now()); wait > 0 {
+			if closed {
+				// Keep what is left for the next process, rather than wait.
+				p.spoolQueue()
+				return
+			}
+			select {
+			case <-currentClock.After(wait):
+			case <-p.closing:
+			}
+			continue
+		}
+		// Spooled items were logged before the queued ones, so they are sent first.
+		if p.spool != nil {
+			if closed && !p.spool.empty() {
+				// Keep the order for the next process, rather than wait for the backlog.
+				p.spoolQueue()
+				return
+			}
+			if name, items, ok := p.spool.oldest(); ok {
+				p.send(items, name)
+				continue
+			}
+		}
+		if items := p.take(pipelineBatchSize); items != nil {
+			p.send(items, "")
+			continue
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-p.wake:
+			p.waitForBatch()
+		case <-p.closing:
+		}
+	}
+}
+
+// waitForBatch waits for a full batch to be queued, the batch interval to pass, or the
+// pipeline to close, so that items are sent together rather than one at a time.
+func (p *TelemetryPipeline) waitForBatch() {
+	select {
+	case <-p.full:
+	default:
+	}
+	p.mu.Lock()
+	ready := len(p.queue) >= pipelineBatchSize || p.closed
+	p.mu.Unlock()
+	if ready {
+		return
+	}
+	select {
+	case <-p.full:
+	case <-currentClock.After(p.settings.BatchInterval):
+	case <-p.closing:
+	}
+}
+
+// send sends items to the sink. Items that could not be sent are put back in the spool
+// file they were read from, or else in a new one, or else at the front of the queue, and
+// sending is paused for a while.
+func (p *TelemetryPipeline) send(items []pipelineItem, spoolName string) {
+	retry, err := p.sink.send(items)
+	if err != nil {
+		p.diagnose("sending %d telemetry items: %v", len(items), err)
+	} else {
+		p.diagnose("sent %d telemetry items", len(items))
+	}
+	if len(retry) == 0 {
+		p.backoff = 0
+		if spoolName != "" {
+			p.spool.remove(spoolName)
+		}
+		return
+	}
+
+	p.backoff *= 2
+	if p.backoff < pipelineMinBackoff {
+		p.backoff = pipelineMinBackoff
+	}
+	if p.backoff > pipelineMaxBackoff {
+		p.backoff = pipelineMaxBackoff
+	}
+	p.retryAt = currentClock.Now().Add(p.backoff)
+	var throttled *throttledError
+	if errors.As(err, &throttled) && throttled.until.After(p.retryAt) {
+		p.retryAt = throttled.until
+	}
+	p.diagnose("retrying %d telemetry items at %s", len(retry), p.retryAt.Format(time.RFC3339))
+
+	switch {
+	case spoolName != "":
+		if err := p.spool.rewrite(spoolName, retry); err != nil {
+			atomic.AddInt64(&p.dropped, int64(len(retry)))
+		}
+	case p.spool != nil:
+		p.spoolBatch(retry)
+	default:
+		p.requeue(retry)
+	}
+}
+
+// requeue puts items that failed to be sent back at the front of the queue. If there is
+// not enough room, the oldest items are dropped.
+func (p *TelemetryPipeline) requeue(items []pipelineItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queue := make([]pipelineItem, 0, len(items)+len(p.queue))
+	queue = append(append(queue, items...), p.queue...)
+	if excess := len(queue) - p.settings.Capacity; excess > 0 {
+		atomic.AddInt64(&p.dropped, int64(excess))
+		queue = queue[excess:]
+	}
+	p.queue = queue
+}
+
+// spoolQueue moves the queued items to the spool.
+func (p *TelemetryPipeline) spoolQueue() {
+	if items := p.take(p.settings.Capacity); items != nil {
+		p.spoolBatch(items)
+	}
+}
+
+func (p *TelemetryPipeline) spoolBatch(items []pipelineItem) {
+	if p.spool != nil && p.spool.writeBatch(items) == nil {
+		atomic.AddInt64(&p.spooled, int64(len(items)))
+		return
+	}
+	atomic.AddInt64(&p.dropped, int64(len(items)))
+}
+
+// close stops accepting items, and waits at most timeout for the queued ones to be sent.
+func (p *TelemetryPipeline) close(timeout time.Duration) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	started := p.started
+	close(p.changed)
+	p.changed = make(chan struct{})
+	p.mu.Unlock()
+	close(p.closing)
+	if started {
+		select {
+		case <-p.done:
+		case <-currentClock.After(timeout):
+		}
+	}
+	if p.spool != nil {
+		p.spool.close()
+	}
+}
+
+// telemetrySeverity ranks telemetry for the DROP_BY_SEVERITY policy.
+func telemetrySeverity(item appinsights.Telemetry) contracts.SeverityLevel {
+	switch t := item.(type) {
+	case *appinsights.MetricTelemetry, *appinsights.AggregateMetricTelemetry:
+		return contracts.Verbose
+	case *appinsights.TraceTelemetry:
+		return t.SeverityLevel
+	case *appinsights.ExceptionTelemetry:
+		return t.SeverityLevel
+	default:
+		return contracts.Information
+	}
+}
+
+// envelop wraps a telemetry item for sending, as appinsights.TelemetryClient.Track does.
+func envelop(context *appinsights.TelemetryContext, item appinsights.Telemetry) *contracts.Envelope {
+	if properties := item.GetProperties(); properties != nil {
+		for k, v := range context.CommonProperties {
+			if _, ok := properties[k]; !ok {
+				properties[k] = v
+			}
+		}
+	}
+
+	data := item.TelemetryData()
+	envelope := contracts.NewEnvelope()
+	envelope.Name = data.EnvelopeName(strings.Replace(context.InstrumentationKey(), "-", "", -1))
+	envelopeData := contracts.NewData()
+	envelopeData.BaseType = data.BaseType()
+	envelopeData.BaseData = data
+	envelope.Data = envelopeData
+	envelope.IKey = context.InstrumentationKey()
+
+	timestamp := item.Time()
+	if timestamp.IsZero() {
+		timestamp = currentClock.Now()
+	}
+	envelope.Time = timestamp.UTC().Format("2006-01-02T15:04:05.999999Z")
+
+	envelope.Tags = item.ContextTags()
+	if envelope.Tags == nil {
+		envelope.Tags = map[string]string{}
+	}
+	for k, v := range context.Tags {
+		if _, ok := envelope.Tags[k]; !ok {
+			envelope.Tags[k] = v
+		}
+	}
+	if _, ok := envelope.Tags[contracts.OperationId]; !ok {
+		envelope.Tags[contracts.OperationId] = uuid.New().String()
+	}
+
+	data.Sanitize()
+	contracts.SanitizeTags(envelope.Tags)
+	return envelope
+}
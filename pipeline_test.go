@@ -0,0 +1,165 @@
+package goservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// ingestionServer counts the requests it receives, and responds to them with status.
+func ingestionServer(t *testing.T, status int) (*httptest.Server, *int64) {
+	requests := new(int64)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(requests, 1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestNewLoggerReportsDeliveredTelemetry(t *testing.T) {
+	server, requests := ingestionServer(t, http.StatusOK)
+	logger := NewLogger("ikey", "test", WithEndpoint(server.URL))
+	for i := 0; i < 3; i++ {
+		logger.Info("started", "started", nil, IrisLogContext{})
+	}
+	logger.(ClosableLogger).Close(time.Second)
+
+	stats := logger.(StatsLogger).Stats()
+	if stats.Accepted != 3 || stats.Dropped != 0 || stats.LastError != "" {
+		t.Errorf("got %+v, want 3 items accepted", stats)
+	}
+	if n := atomic.LoadInt64(requests); n != 1 {
+		t.Errorf("got %d requests, want the items sent in one batch", n)
+	}
+}
+
+func TestNewLoggerReportsRejectedTelemetry(t *testing.T) {
+	server, _ := ingestionServer(t, http.StatusBadRequest)
+	logger := NewLogger("ikey", "test", WithEndpoint(server.URL))
+	logger.Info("started", "started", nil, IrisLogContext{})
+	logger.(ClosableLogger).Close(time.Second)
+
+	stats := logger.(StatsLogger).Stats()
+	if stats.Rejected != 1 || stats.LastError == "" || stats.LastErrorAt.IsZero() {
+		t.Errorf("got %+v, want the item rejected", stats)
+	}
+}
+
+// testItem is a queue item identified by name.
+func testItem(name string, severity contracts.SeverityLevel) pipelineItem {
+	return pipelineItem{Severity: severity, Envelope: &contracts.Envelope{Name: name}}
+}
+
+// queued returns the names of the queued items, in order.
+func queued(p *TelemetryPipeline) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := []string{}
+	for _, item := range p.queue {
+		names = append(names, item.Envelope.Name)
+	}
+	return names
+}
+
+func TestPipelineDropPolicies(t *testing.T) {
+	tests := []struct {
+		policy      string
+		items       []pipelineItem
+		wantQueued  []string
+		wantDropped int64
+	}{
+		{
+			policy:      DROP_OLDEST,
+			items:       []pipelineItem{testItem("a", contracts.Error), testItem("b", contracts.Verbose), testItem("c", contracts.Information), testItem("d", contracts.Verbose)},
+			wantQueued:  []string{"b", "c", "d"},
+			wantDropped: 1,
+		},
+		{
+			policy: DROP_BY_SEVERITY,
+			items: []pipelineItem{
+				testItem("a", contracts.Information), testItem("b", contracts.Verbose), testItem("c", contracts.Information),
+				// Drops b, the least severe.
+				testItem("d", contracts.Warning),
+				// Is dropped, as everything queued is more severe.
+				testItem("e", contracts.Verbose),
+				// Drops a, the oldest of the least severe.
+				testItem("f", contracts.Information),
+			},
+			wantQueued:  []string{"c", "d", "f"},
+			wantDropped: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			p := NewTelemetryPipeline(PipelineSettings{Capacity: 3, DropPolicy: test.policy})
+			for _, item := range test.items {
+				p.add(item)
+			}
+			if got := queued(p); !reflect.DeepEqual(got, test.wantQueued) {
+				t.Errorf("got %v queued, want %v", got, test.wantQueued)
+			}
+			if stats := p.Stats(); stats.Dropped != test.wantDropped || stats.Depth != len(test.wantQueued) {
+				t.Errorf("got %+v, want %d dropped", stats, test.wantDropped)
+			}
+		})
+	}
+}
+
+func TestPipelineBlockPolicy(t *testing.T) {
+	clock := useFakeClock(t)
+	p := NewTelemetryPipeline(PipelineSettings{Capacity: 1, DropPolicy: BLOCK, BlockTimeout: time.Second})
+	p.add(testItem("a", contracts.Information))
+
+	// Room is made while b waits, so it is queued.
+	added := make(chan struct{})
+	go func() {
+		p.add(testItem("b", contracts.Information))
+		close(added)
+	}()
+	for clock.WatcherCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if taken := p.take(1); len(taken) != 1 || taken[0].Envelope.Name != "a" {
+		t.Fatalf("took %v, want a", taken)
+	}
+	<-added
+	if got := queued(p); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("got %v queued, want b", got)
+	}
+
+	// No room is made while c waits, so it is dropped after the timeout.
+	added = make(chan struct{})
+	go func() {
+		p.add(testItem("c", contracts.Information))
+		close(added)
+	}()
+	clock.WaitForWatcherAndIncrement(time.Second)
+	<-added
+	if got := queued(p); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("got %v queued, want b", got)
+	}
+	if stats := p.Stats(); stats.Dropped != 1 {
+		t.Errorf("got %+v, want c dropped", stats)
+	}
+
+	// Closing the pipeline drops what is waiting.
+	added = make(chan struct{})
+	go func() {
+		p.add(testItem("d", contracts.Information))
+		close(added)
+	}()
+	for clock.WatcherCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p.close(time.Second)
+	<-added
+	if stats := p.Stats(); stats.Dropped != 2 {
+		t.Errorf("got %+v, want d dropped", stats)
+	}
+}
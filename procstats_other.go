@@ -0,0 +1,15 @@
+//go:build !unix
+
+package goservice
+
+import "time"
+
+// processCPUTime is not supported on this platform.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
+
+// openFileDescriptors is not supported on this platform.
+func openFileDescriptors() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,156 @@
+package goservice
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metrics recorded by HttpRequestHandler when given WithMetrics.
+const (
+	METRIC_HTTP_REQUEST_DURATION = "http_request_duration_seconds"
+	METRIC_HTTP_REQUEST_ERRORS   = "http_request_errors_total"
+)
+
+// WithMetrics records a duration histogram of each request, by route, method and status,
+// and a count of the errors returned, by TypeCode. The route is the operation name set by
+// the router, so that paths with ids in them don't each make a series.
+func WithMetrics(registry *MetricsRegistry) HandlerOption {
+	return func(options *handlerOptions) {
+		options.metrics = registry
+	}
+}
+
+func (options *handlerOptions) recordRequest(route string, method string, status int, seconds float64, err *IrisError) {
+	if options.metrics == nil {
+		return
+	}
+	options.metrics.Histogram(METRIC_HTTP_REQUEST_DURATION).Observe(seconds, map[string]string{
+		"route":  route,
+		"method": method,
+		"status": strconv.Itoa(status),
+	})
+	if err != nil {
+		options.metrics.Counter(METRIC_HTTP_REQUEST_ERRORS).Add(1, map[string]string{
+			"type_code": err.TypeCode,
+		})
+	}
+}
+
+// PrometheusHandler serves the registry's metrics in the Prometheus text format, to be
+// mounted on /metrics. Counters and histograms are totals since each series was created,
+// and are not reset by the registry's flushes, so a registry without a Logger can be used
+// for Prometheus alone.
+func (r *MetricsRegistry) PrometheusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+		r.writePrometheus(out)
+		out.Flush()
+	}
+}
+
+// writePrometheus writes a family for each metric name. Names that Prometheus doesn't
+// allow are sanitised; when several names sanitise to the same one, only the series of the
+// first, in sorted order, are written, as Prometheus rejects repeated families.
+func (r *MetricsRegistry) writePrometheus(out *bufio.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type entry struct {
+		name   string
+		key    string
+		series *metricSeries
+	}
+	entries := make([]entry, 0, len(r.series))
+	for key, series := range r.series {
+		entries = append(entries, entry{prometheusName(series.name), key, series})
+	}
+	// Keys start with the metric name, so the series of a metric end up together, after
+	// those of any metric whose name sanitises to the same and sorts before it.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].name != entries[j].name {
+			return entries[i].name < entries[j].name
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	lastName, owner := "", ""
+	for _, entry := range entries {
+		name, series := entry.name, entry.series
+		if name != lastName {
+			out.WriteString("# TYPE " + name + " " + series.kind + "\n")
+			lastName, owner = name, series.name
+		}
+		if series.name != owner {
+			continue
+		}
+		switch series.kind {
+		case METRIC_HISTOGRAM:
+			cumulative := 0
+			for i, bound := range r.settings.Buckets {
+				cumulative += series.buckets[i]
+				writePrometheusSample(out, name+"_bucket", series.dimensions, "le", prometheusFloat(bound), float64(cumulative))
+			}
+			writePrometheusSample(out, name+"_bucket", series.dimensions, "le", "+Inf", float64(series.totalCount))
+			writePrometheusSample(out, name+"_sum", series.dimensions, "", "", series.total)
+			writePrometheusSample(out, name+"_count", series.dimensions, "", "", float64(series.totalCount))
+		case METRIC_GAUGE:
+			writePrometheusSample(out, name, series.dimensions, "", "", series.sum)
+		default:
+			writePrometheusSample(out, name, series.dimensions, "", "", series.total)
+		}
+	}
+}
+
+// writePrometheusSample writes one sample line, with the dimensions as labels, and an
+// extra label if extraName is set.
+func writePrometheusSample(out *bufio.Writer, name string, dimensions map[string]string, extraName string, extraValue string, value float64) {
+	out.WriteString(name)
+	labels := make([]string, 0, len(dimensions))
+	for k := range dimensions {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	if len(labels) > 0 || extraName != "" {
+		out.WriteString("{")
+		for i, k := range labels {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString(prometheusName(k) + `="` + prometheusLabelValue(dimensions[k]) + `"`)
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		out.WriteString("}")
+	}
+	out.WriteString(" " + prometheusFloat(value) + "\n")
+}
+
+// prometheusName replaces the characters Prometheus doesn't allow in names with `_`.
+func prometheusName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabelValue(value string) string {
+	return prometheusLabelEscaper.Replace(value)
+}
+
+func prometheusFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,61 @@
+package goservice
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	registry := NewMetricsRegistry(MetricsSettings{Buckets: []float64{0.25, 1}})
+	requests := registry.Counter("http.requests")
+	requests.Add(1, map[string]string{"path": "a\"b\\c\n", "http.method": "GET"})
+	requests.Add(2, map[string]string{"path": "a\"b\\c\n", "http.method": "GET"})
+	// Sanitises to the same name as http.requests, which sorts first.
+	registry.Counter("http_requests").Add(5, nil)
+	registry.Counter("9lives").Add(1, nil)
+	for _, value := range []float64{0.25, 0.5, 2} {
+		registry.Histogram("latency").Observe(value, map[string]string{"route": "/users"})
+	}
+	queue := registry.Gauge("queue-length")
+	queue.Set(7, nil)
+	queue.Set(4, nil)
+	// Flushing resets the summaries, but not what Prometheus is given.
+	registry.Flush()
+
+	recorder := httptest.NewRecorder()
+	registry.PrometheusHandler()(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# TYPE _lives counter
+_lives 1
+# TYPE http_requests counter
+http_requests{http_method="GET",path="a\"b\\c\n"} 3
+# TYPE latency histogram
+latency_bucket{route="/users",le="0.25"} 1
+latency_bucket{route="/users",le="1"} 2
+latency_bucket{route="/users",le="+Inf"} 3
+latency_sum{route="/users"} 2.75
+latency_count{route="/users"} 3
+# TYPE queue_length gauge
+queue_length 4
+`
+	if got := recorder.Body.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("got Content-Type %q", contentType)
+	}
+}
+
+func TestPrometheusName(t *testing.T) {
+	for name, want := range map[string]string{
+		"http_requests_total": "http_requests_total",
+		"http.requests-total": "http_requests_total",
+		"ns:metric":           "ns:metric",
+		"2xx":                 "_xx",
+		"p99.9":               "p99_9",
+	} {
+		if got := prometheusName(name); got != want {
+			t.Errorf("prometheusName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
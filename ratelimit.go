@@ -0,0 +1,195 @@
+package goservice
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitStore keeps the token buckets used by RateLimit. MemoryRateLimitStore keeps
+// them in process; implement this interface to share limits between instances.
+type RateLimitStore interface {
+	// Take removes a token from the bucket for key, which refills at rate tokens per
+	// second up to burst tokens. If the bucket is empty it returns false and how long
+	// until a token will be available.
+	Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error)
+}
+
+// RateLimitKeyFunc returns the key requests are limited by. Requests with an empty key
+// are not limited.
+type RateLimitKeyFunc func(r *http.Request, context IrisLogContext) string
+
+// RateLimitByClientAddress limits each address requests are received from. Behind a proxy
+// or load balancer, use RateLimitByForwardedAddress instead.
+func RateLimitByClientAddress(r *http.Request, context IrisLogContext) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitByForwardedAddress limits each client address, for a service behind
+// trustedProxies proxies that each append the address they received the request from to
+// the X-Forwarded-For header. The address is the one appended by the outermost trusted
+// proxy, since the entries before it are sent by the client and can't be trusted. If the
+// header has fewer entries than that, the address the request was received from is used.
+func RateLimitByForwardedAddress(trustedProxies int) RateLimitKeyFunc {
+	return func(r *http.Request, context IrisLogContext) string {
+		var entries []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			entries = append(entries, strings.Split(header, ",")...)
+		}
+		if trustedProxies <= 0 || len(entries) < trustedProxies {
+			return RateLimitByClientAddress(r, context)
+		}
+		return strings.TrimSpace(entries[len(entries)-trustedProxies])
+	}
+}
+
+// RateLimitByUser limits each user of the log context.
+func RateLimitByUser(r *http.Request, context IrisLogContext) string {
+	return context.UserId
+}
+
+// RateLimitByRoute limits each method and path, across all clients.
+func RateLimitByRoute(r *http.Request, context IrisLogContext) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// RateLimitSettings configures RateLimit. Zero fields are replaced by the defaults noted
+// on them.
+type RateLimitSettings struct {
+	// Name identifies the limiter in telemetry.
+	Name string
+	// Rate is the sustained number of requests allowed per second for each key. It is
+	// required, and RateLimit panics if it isn't positive.
+	Rate float64
+	// Burst is the number of requests allowed at once. Defaults to the rate, rounded up.
+	Burst int
+	// Key chooses what requests are limited by. Defaults to RateLimitByClientAddress.
+	Key RateLimitKeyFunc
+	// Store holds the buckets. Defaults to a new MemoryRateLimitStore.
+	Store RateLimitStore
+	// Logger receives a metric for each rejected request, and an error if the store
+	// fails. Optional.
+	Logger IrisLogger
+}
+
+// RateLimit returns a middleware that rejects requests over the limit with a
+// `too_many_requests` error, which HttpRequestHandler sends as a 429 with a Retry-After
+// header. If the store fails the request is let through, so that an outage of a shared
+// store doesn't take the service down with it.
+func RateLimit(settings RateLimitSettings) Middleware {
+	if !(settings.Rate > 0) {
+		panic("goservice: RateLimitSettings.Rate must be positive")
+	}
+	if settings.Burst <= 0 {
+		settings.Burst = int(math.Max(1, math.Ceil(settings.Rate)))
+	}
+	if settings.Key == nil {
+		settings.Key = RateLimitByClientAddress
+	}
+	if settings.Store == nil {
+		settings.Store = NewMemoryRateLimitStore()
+	}
+	return func(next HttpRequestHandlerFunc) HttpRequestHandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+			key := settings.Key(r, context)
+			if key == "" {
+				return next(w, r, context)
+			}
+			allowed, wait, err := settings.Store.Take(r.Context(), settings.Name+":"+key, settings.Rate, settings.Burst)
+			if err != nil {
+				if settings.Logger != nil {
+					settings.Logger.Error("rate_limit_store_failed", err, map[string]string{"limiter": settings.Name}, context)
+				}
+				return next(w, r, context)
+			}
+			if !allowed {
+				if settings.Logger != nil {
+					settings.Logger.Metric("rate_limit."+settings.Name+".rejected", 1, context)
+				}
+				return TooManyRequests("rate_limited", "too many requests, try again later", map[string]string{
+					"limiter":         settings.Name,
+					PARAM_RETRY_AFTER: strconv.Itoa(int(math.Ceil(wait.Seconds()))),
+				})
+			}
+			return next(w, r, context)
+		}
+	}
+}
+
+// memoryRateLimitStoreSweep is the number of buckets above which full buckets are removed.
+const memoryRateLimitStoreSweep = 10000
+
+// tokenBucket is the bucket of a key, with the rate and burst it was last taken from with,
+// since a store may be shared by limiters with different limits.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+// MemoryRateLimitStore is a RateLimitStore that keeps buckets in memory, using the
+// package clock. Buckets that have refilled completely are dropped as the store grows.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// sweepAt is the number of buckets at which the next sweep happens. It grows with the
+	// buckets left after a sweep, so that sweeps stay rare when most buckets are in use.
+	sweepAt int
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: map[string]*tokenBucket{},
+		sweepAt: memoryRateLimitStoreSweep,
+	}
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := currentClock.Now()
+	if len(s.buckets) >= s.sweepAt {
+		s.sweep(now)
+	}
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = bucket
+	}
+	bucket.rate, bucket.burst = rate, burst
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0, nil
+	}
+	if rate <= 0 {
+		return false, time.Hour, nil
+	}
+	return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second)), nil
+}
+
+// sweep removes the buckets that have refilled completely, which are the same as new ones.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, bucket := range s.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate >= float64(bucket.burst) {
+			delete(s.buckets, key)
+		}
+	}
+	s.sweepAt = 2 * len(s.buckets)
+	if s.sweepAt < memoryRateLimitStoreSweep {
+		s.sweepAt = memoryRateLimitStoreSweep
+	}
+}
@@ -0,0 +1,59 @@
+package goservice
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitByForwardedAddress(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:5000"
+	r.Header.Add("X-Forwarded-For", "1.1.1.1, 203.0.113.7")
+	r.Header.Add("X-Forwarded-For", "10.0.0.1")
+
+	tests := []struct {
+		trustedProxies int
+		want           string
+	}{
+		{0, "10.0.0.2"},
+		{1, "10.0.0.1"},
+		{2, "203.0.113.7"},
+		{4, "10.0.0.2"},
+	}
+	for _, test := range tests {
+		if got := RateLimitByForwardedAddress(test.trustedProxies)(r, IrisLogContext{}); got != test.want {
+			t.Errorf("with %d trusted proxies got %q, want %q", test.trustedProxies, got, test.want)
+		}
+	}
+	if got := RateLimitByClientAddress(r, IrisLogContext{}); got != "10.0.0.2" {
+		t.Errorf("RateLimitByClientAddress got %q, want the remote address", got)
+	}
+}
+
+func TestRateLimitRequiresRate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RateLimit accepted a zero rate")
+		}
+	}()
+	RateLimit(RateLimitSettings{Name: "api"})
+}
+
+func TestMemoryRateLimitStoreSweepKeepsOtherLimits(t *testing.T) {
+	clock := useFakeClock(t)
+	store := NewMemoryRateLimitStore()
+	store.sweepAt = 2
+	ctx := context.Background()
+
+	// A slow limiter empties its bucket, then a fast limiter sweeps the store.
+	store.Take(ctx, "slow:a", 0.01, 1)
+	clock.Increment(time.Second)
+	store.Take(ctx, "fast:a", 100, 1)
+	store.Take(ctx, "fast:b", 100, 1)
+
+	if allowed, _, _ := store.Take(ctx, "slow:a", 0.01, 1); allowed {
+		t.Error("the sweep refilled a bucket with the rate of another limiter")
+	}
+}
@@ -0,0 +1,172 @@
+package goservice
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// PARAM_RETRY_AFTER is the error param used to tell callers how long to wait before
+// retrying. Its value is either a number of seconds, as in the HTTP Retry-After header,
+// or a Go duration string such as `1.5s`.
+const PARAM_RETRY_AFTER = "retry_after"
+
+// RetryPolicy configures Retry. Zero fields are replaced by the defaults noted on them.
+type RetryPolicy struct {
+	// Name identifies the operation in telemetry.
+	Name string
+	// MaxAttempts is the maximum number of calls, including the first. Defaults to 3.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. Defaults to 100ms.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts. Defaults to 10s.
+	MaxBackoff time.Duration
+	// Multiplier grows the backoff after each attempt. Defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, of each backoff that is randomised so
+	// that clients don't retry in lockstep.
+	Jitter float64
+	// MaxElapsed is the total time allowed for all attempts, including waits.
+	// There is no limit when it is zero, other than the deadline of the context.
+	MaxElapsed time.Duration
+	// Logger receives a warning for each retry, and a dependency for each attempt if it is
+	// a DependencyLogger. Optional.
+	Logger IrisLogger
+}
+
+// jitterRand is replaced in tests to make the jitter predictable.
+var jitterRand = rand.Float64
+
+func (policy RetryPolicy) withDefaults() RetryPolicy {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = 100 * time.Millisecond
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = 10 * time.Second
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 2
+	}
+	policy.Jitter = math.Max(0, math.Min(1, policy.Jitter))
+	return policy
+}
+
+// backoff returns the wait before the given retry, counting from zero.
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	backoff := float64(policy.InitialBackoff) * math.Pow(policy.Multiplier, float64(retry))
+	backoff = math.Min(backoff, float64(policy.MaxBackoff))
+	backoff -= backoff * policy.Jitter * jitterRand()
+	return time.Duration(backoff)
+}
+
+// Retry calls fn until it succeeds, returns an error that is not retryable, or the policy
+// runs out of attempts or time. Errors are retryable according to `IrisError.Retryable`;
+// errors that are not IrisErrors are retryable, as they would be once wrapped.
+// If the error has a `retry_after` param, that wait is used instead of the backoff.
+//
+// Waits use the package clock, and stop early if ctx is done. The log context is taken
+// from ctx, see `WithLogContext`. When retries run out, the last error is returned
+// augmented with the number of attempts.
+func Retry(ctx context.Context, policy RetryPolicy, fn func(ctx context.Context) error) error {
+	policy = policy.withDefaults()
+	logContext := LogContextFrom(ctx)
+	start := currentClock.Now()
+	var deadline time.Time
+	if policy.MaxElapsed > 0 {
+		deadline = start.Add(policy.MaxElapsed)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptStart := currentClock.Now()
+		err := fn(ctx)
+		duration := currentClock.Since(attemptStart)
+		if logger, ok := policy.Logger.(DependencyLogger); ok {
+			resultCode := ""
+			if iriserr, ok := As(err); ok {
+				resultCode = iriserr.Code
+			}
+			logger.Dependency(policy.Name, "retry", "attempt "+strconv.Itoa(attempt), duration, err == nil, resultCode, logContext)
+		}
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			return retriesExhausted(err, attempt)
+		}
+
+		wait := policy.backoff(attempt - 1)
+		if retryAfter, ok := retryAfterHint(err); ok {
+			wait = retryAfter
+		}
+		if !deadline.IsZero() && currentClock.Now().Add(wait).After(deadline) {
+			return retriesExhausted(err, attempt)
+		}
+		if policy.Logger != nil {
+			policy.Logger.Warning("retry_attempt_failed", err.Error(), map[string]string{
+				"name":    policy.Name,
+				"attempt": strconv.Itoa(attempt),
+				"wait":    wait.String(),
+			}, logContext)
+		}
+
+		timer := currentClock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return retriesExhausted(err, attempt)
+		case <-timer.C():
+		}
+	}
+}
+
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if iriserr, ok := As(err); ok {
+		return iriserr.Retryable()
+	}
+	return true
+}
+
+func retriesExhausted(err error, attempts int) error {
+	return Augment(err, "retries exhausted", map[string]string{
+		"attempts": strconv.Itoa(attempts),
+	})
+}
+
+// retryAfterHint returns the wait requested by the `retry_after` param of the first
+// IrisError in the chain that has one.
+func retryAfterHint(err error) (time.Duration, bool) {
+	var wait time.Duration
+	found := false
+	Walk(err, func(err error) bool {
+		iriserr, ok := err.(*IrisError)
+		if !ok {
+			return true
+		}
+		value, ok := iriserr.Params[PARAM_RETRY_AFTER]
+		if !ok {
+			return true
+		}
+		if seconds, parseErr := strconv.ParseFloat(value, 64); parseErr == nil {
+			wait, found = time.Duration(seconds*float64(time.Second)), true
+		} else if d, parseErr := time.ParseDuration(value); parseErr == nil {
+			wait, found = d, true
+		}
+		return !found
+	})
+	return wait, found
+}
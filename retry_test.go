@@ -0,0 +1,30 @@
+package goservice
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestRetryStopsOnWrappedContextErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, wrap := range []func(error) error{
+		func(err error) error { return err },
+		func(err error) error { return fmt.Errorf("calling billing: %w", err) },
+		func(err error) error { return Wrap(err, nil) },
+	} {
+		calls := 0
+		err := Retry(context.Background(), RetryPolicy{MaxAttempts: 3}, func(context.Context) error {
+			calls++
+			return wrap(ctx.Err())
+		})
+		if err == nil {
+			t.Fatal("Retry returned nil")
+		}
+		if calls != 1 {
+			t.Errorf("%v was retried: %d calls", err, calls)
+		}
+	}
+}
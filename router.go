@@ -0,0 +1,177 @@
+package goservice
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Router dispatches requests to handlers by method and path template. Templates are
+// paths whose segments may be parameters, e.g. `/users/{id}`, and whose last segment may
+// be a wildcard matching the rest of the path, e.g. `/files/{path...}`. A wildcard matches
+// at least one segment, so `/files` needs a route of its own. Static segments take
+// precedence over parameters, so `/users/me` wins over `/users/{id}`.
+//
+// Every request goes through HttpRequestHandler, so unmatched requests are logged and
+// answered with `not_found` or `method_not_allowed` errors like any other, and matched
+// requests are logged with `METHOD template` as their operation name.
+type Router struct {
+	chain   Chain
+	routes  []*route
+	handler http.HandlerFunc
+}
+
+type route struct {
+	method   string
+	template string
+	segments []string
+	handler  HttpRequestHandlerFunc
+}
+
+// NewRouter creates an empty router logging to logger.
+func NewRouter(logger IrisLogger, opts ...HandlerOption) *Router {
+	rt := &Router{}
+	rt.handler = HttpRequestHandler(rt.dispatch, logger, opts...)
+	return rt
+}
+
+// Use adds middleware to every route registered after it.
+func (rt *Router) Use(middlewares ...Middleware) {
+	rt.chain = rt.chain.Append(middlewares...)
+}
+
+// Handle registers h for the method and path template. The middleware given here only
+// applies to this route, and runs after the router's middleware.
+func (rt *Router) Handle(method string, template string, h HttpRequestHandlerFunc, middlewares ...Middleware) {
+	rt.routes = append(rt.routes, &route{
+		method:   strings.ToUpper(method),
+		template: template,
+		segments: splitPath(template),
+		handler:  rt.chain.Append(middlewares...).Then(h),
+	})
+	// Keep the most specific routes first, so the first match is the best one.
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return rt.routes[i].moreSpecificThan(rt.routes[j])
+	})
+}
+
+// ServeHTTP implements http.Handler.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.handler(w, r)
+}
+
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+	segments := splitPath(r.URL.Path)
+	var allowed []string
+	for _, route := range rt.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method != r.Method {
+			if !containsString(allowed, route.method) {
+				allowed = append(allowed, route.method)
+			}
+			continue
+		}
+		context.OperationName = route.method + " " + route.template
+		SetRequestOperationName(r, context.OperationName)
+		r = r.WithContext(withPathParams(WithLogContext(r.Context(), context), params))
+		return route.handler(w, r, context)
+	}
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		return MethodNotAllowed("", "method "+r.Method+" is not allowed for "+r.URL.Path, map[string]string{
+			"method": r.Method,
+			"allow":  strings.Join(allowed, ", "),
+		})
+	}
+	return NotFound("route", "no route matches "+r.URL.Path, map[string]string{
+		"path": r.URL.Path,
+	})
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func isParamSegment(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+func isWildcardSegment(segment string) bool {
+	return isParamSegment(segment) && strings.HasSuffix(segment, "...}")
+}
+
+func paramName(segment string) string {
+	return strings.TrimSuffix(segment[1:len(segment)-1], "...")
+}
+
+// match returns the path params if the route's template matches the path segments.
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	params := map[string]string{}
+	for i, segment := range rt.segments {
+		if isWildcardSegment(segment) {
+			if i >= len(segments) {
+				return nil, false
+			}
+			params[paramName(segment)] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if isParamSegment(segment) {
+			params[paramName(segment)] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, len(segments) == len(rt.segments)
+}
+
+// moreSpecificThan compares templates segment by segment: static segments beat
+// parameters, which beat wildcards.
+func (rt *route) moreSpecificThan(other *route) bool {
+	for i := 0; i < len(rt.segments) && i < len(other.segments); i++ {
+		a, b := segmentRank(rt.segments[i]), segmentRank(other.segments[i])
+		if a != b {
+			return a < b
+		}
+	}
+	return len(rt.segments) > len(other.segments)
+}
+
+func segmentRank(segment string) int {
+	switch {
+	case isWildcardSegment(segment):
+		return 2
+	case isParamSegment(segment):
+		return 1
+	}
+	return 0
+}
+
+type pathParamsKey struct{}
+
+func withPathParams(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, pathParamsKey{}, params)
+}
+
+// PathParams returns the path params of the route matched by Router.
+func PathParams(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(pathParamsKey{}).(map[string]string)
+	return params
+}
+
+// PathParam returns the named path param of the route matched by Router, or an empty
+// string if there is none.
+func PathParam(r *http.Request, name string) string {
+	return PathParams(r.Context())[name]
+}
@@ -0,0 +1,50 @@
+package goservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterMatchesMostSpecificRoute(t *testing.T) {
+	router := NewRouter(&recordingLogger{})
+	for _, template := range []string{"/files", "/files/{path...}", "/users/{id}", "/users/me"} {
+		template := template
+		router.Handle("GET", template, func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+			w.Write([]byte(template + " " + PathParam(r, "path") + PathParam(r, "id")))
+			return nil
+		})
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/files", "/files "},
+		{"/files/", "/files "},
+		{"/files/a", "/files/{path...} a"},
+		{"/files/a/b.txt", "/files/{path...} a/b.txt"},
+		{"/users/me", "/users/me "},
+		{"/users/42", "/users/{id} 42"},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", test.path, nil))
+		if got := recorder.Body.String(); got != test.want {
+			t.Errorf("GET %s got %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestRouterWildcardNeedsASegment(t *testing.T) {
+	router := NewRouter(&recordingLogger{})
+	router.Handle("GET", "/files/{path...}", func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+		return nil
+	})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/files", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", recorder.Code)
+	}
+}
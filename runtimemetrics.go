@@ -0,0 +1,127 @@
+package goservice
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// RuntimeMetricsSettings configures StartRuntimeMetrics. Zero fields are replaced by the
+// defaults noted on them.
+type RuntimeMetricsSettings struct {
+	// Logger receives the metrics.
+	Logger IrisLogger
+	// Role is added to each metric as the `role` property, so services sharing a
+	// telemetry resource can be told apart.
+	Role string
+	// Interval is the time between reports. Defaults to 60s.
+	Interval time.Duration
+	// Prefix is prepended to each metric name. Defaults to `runtime.`.
+	Prefix string
+}
+
+// RuntimeMetrics reports Go process statistics through IrisLogger.Metric at an interval:
+// goroutines, heap usage, garbage collections and their pause time, CPU usage, open file
+// descriptors and in-flight HTTP requests. CPU and file descriptors are only reported on
+// platforms that support them.
+type RuntimeMetrics struct {
+	settings RuntimeMetricsSettings
+	context  IrisLogContext
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu          sync.Mutex
+	lastAt      time.Time
+	lastCPU     time.Duration
+	lastNumGC   uint32
+	lastPauseNs uint64
+}
+
+// StartRuntimeMetrics starts reporting in the background until Stop is called.
+func StartRuntimeMetrics(settings RuntimeMetricsSettings) *RuntimeMetrics {
+	if settings.Logger == nil {
+		panic("goservice: RuntimeMetricsSettings.Logger is required")
+	}
+	if settings.Interval <= 0 {
+		settings.Interval = 60 * time.Second
+	}
+	if settings.Prefix == "" {
+		settings.Prefix = "runtime."
+	}
+	m := &RuntimeMetrics{
+		settings: settings,
+		context:  IrisLogContext{Properties: map[string]string{}},
+		stop:     make(chan struct{}),
+	}
+	if settings.Role != "" {
+		m.context.Properties["role"] = settings.Role
+	}
+	m.baseline()
+	ticker := currentClock.NewTicker(settings.Interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C():
+				m.Collect()
+			}
+		}
+	}()
+	return m
+}
+
+// Stop stops reporting.
+func (m *RuntimeMetrics) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// baseline records the counters that are reported as changes since the last report.
+func (m *RuntimeMetrics) baseline() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastAt = currentClock.Now()
+	m.lastCPU, _ = processCPUTime()
+	m.lastNumGC = stats.NumGC
+	m.lastPauseNs = stats.PauseTotalNs
+}
+
+// Collect reports the metrics once. GC and CPU figures cover the time since the
+// previous report.
+func (m *RuntimeMetrics) Collect() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	now := currentClock.Now()
+	cpu, cpuOk := processCPUTime()
+
+	m.mu.Lock()
+	elapsed := now.Sub(m.lastAt)
+	gcCount := stats.NumGC - m.lastNumGC
+	gcPause := time.Duration(stats.PauseTotalNs - m.lastPauseNs)
+	cpuUsed := cpu - m.lastCPU
+	m.lastAt, m.lastCPU, m.lastNumGC, m.lastPauseNs = now, cpu, stats.NumGC, stats.PauseTotalNs
+	m.mu.Unlock()
+
+	m.metric("goroutines", float64(runtime.NumGoroutine()))
+	m.metric("heap_alloc_bytes", float64(stats.HeapAlloc))
+	m.metric("heap_inuse_bytes", float64(stats.HeapInuse))
+	m.metric("heap_objects", float64(stats.HeapObjects))
+	m.metric("gc_count", float64(gcCount))
+	m.metric("gc_pause_ms", float64(gcPause)/float64(time.Millisecond))
+	m.metric("http_requests_in_flight", float64(InFlightRequests()))
+	if cpuOk && elapsed > 0 {
+		m.metric("cpu_percent", 100*float64(cpuUsed)/float64(elapsed)/float64(runtime.NumCPU()))
+	}
+	if fds, ok := openFileDescriptors(); ok {
+		m.metric("open_fds", float64(fds))
+	}
+}
+
+func (m *RuntimeMetrics) metric(name string, value float64) {
+	m.settings.Logger.Metric(m.settings.Prefix+name, value, m.context)
+}
@@ -0,0 +1,95 @@
+package goservice
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRuntimeMetricsRequiresLogger(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("StartRuntimeMetrics without a Logger did not panic")
+		}
+	}()
+	StartRuntimeMetrics(RuntimeMetricsSettings{})
+}
+
+func TestRuntimeMetricsCollect(t *testing.T) {
+	clock := useFakeClock(t)
+	logger := &recordingLogger{}
+	metrics := StartRuntimeMetrics(RuntimeMetricsSettings{Logger: logger, Role: "api", Prefix: "go."})
+	defer metrics.Stop()
+
+	runtime.GC()
+	clock.Increment(time.Second)
+	metrics.Collect()
+
+	values := map[string]float64{}
+	for _, metric := range logger.byKind("metric") {
+		if metric.Context.Properties["role"] != "api" {
+			t.Errorf("%s has properties %v, want the role", metric.Name, metric.Context.Properties)
+		}
+		values[metric.Name] = metric.Value
+	}
+	for _, name := range []string{"go.goroutines", "go.heap_alloc_bytes", "go.heap_inuse_bytes", "go.heap_objects", "go.gc_count", "go.gc_pause_ms", "go.http_requests_in_flight"} {
+		if _, ok := values[name]; !ok {
+			t.Errorf("%s was not reported: %v", name, values)
+		}
+	}
+	if values["go.goroutines"] < 1 || values["go.heap_alloc_bytes"] <= 0 {
+		t.Errorf("got implausible values %v", values)
+	}
+	if values["go.gc_count"] < 1 {
+		t.Errorf("got gc_count %v, want the collection since the baseline", values["go.gc_count"])
+	}
+	if _, ok := processCPUTime(); ok {
+		if cpu, ok := values["go.cpu_percent"]; !ok || cpu < 0 {
+			t.Errorf("got cpu_percent %v, %v", cpu, ok)
+		}
+	}
+	if _, ok := openFileDescriptors(); ok && values["go.open_fds"] < 1 {
+		t.Errorf("got open_fds %v, want the open descriptors", values["go.open_fds"])
+	}
+}
+
+func TestRuntimeMetricsReportsAtInterval(t *testing.T) {
+	clock := useFakeClock(t)
+	logger := &recordingLogger{}
+	metrics := StartRuntimeMetrics(RuntimeMetricsSettings{Logger: logger, Interval: 10 * time.Second})
+
+	clock.WaitForWatcherAndIncrement(10 * time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(logger.byKind("metric")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	metrics.Stop()
+	metrics.Stop()
+
+	reported := logger.byKind("metric")
+	if len(reported) == 0 {
+		t.Fatal("nothing was reported after the interval")
+	}
+	if reported[0].Name != "runtime.goroutines" {
+		t.Errorf("got %s, want the default prefix", reported[0].Name)
+	}
+}
+
+func TestProcessStats(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("process statistics are only checked on linux and darwin")
+	}
+	before, ok := processCPUTime()
+	if !ok {
+		t.Fatal("processCPUTime is not supported")
+	}
+	for start := time.Now(); time.Since(start) < 20*time.Millisecond; {
+	}
+	if after, _ := processCPUTime(); after <= before {
+		t.Errorf("CPU time went from %v to %v while busy", before, after)
+	}
+	fds, ok := openFileDescriptors()
+	if !ok || fds < 3 {
+		t.Errorf("got %d open descriptors, %v, want at least stdin, stdout and stderr", fds, ok)
+	}
+}
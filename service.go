@@ -0,0 +1,194 @@
+package goservice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ServiceSettings configures a Service. Zero fields are replaced by the defaults noted on
+// them.
+type ServiceSettings struct {
+	// Name is the service's role in telemetry.
+	Name string
+	// InstrumentationKey is used to create the logger when Logger is nil.
+	InstrumentationKey string
+	// Logger overrides the logger created from the instrumentation key.
+	Logger IrisLogger
+	// Address is the address to listen on. Defaults to `:8080`.
+	Address string
+	// ReadHeaderTimeout defaults to 5s, ReadTimeout and WriteTimeout to 30s and
+	// IdleTimeout to 120s. They are passed on to the http.Server.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// DrainPeriod is how long the service reports that it isn't ready before it stops
+	// accepting connections, giving load balancers time to stop sending it requests.
+	// Defaults to 5s.
+	DrainPeriod time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish. Defaults to 30s.
+	ShutdownTimeout time.Duration
+	// FlushTimeout is how long the logger gets to send queued telemetry. Defaults to 10s.
+	FlushTimeout time.Duration
+	// HealthCacheFor is how long health check results are reused. Defaults to 5s.
+	HealthCacheFor time.Duration
+}
+
+func (settings ServiceSettings) withDefaults() ServiceSettings {
+	defaultDuration := func(d *time.Duration, value time.Duration) {
+		if *d <= 0 {
+			*d = value
+		}
+	}
+	if settings.Address == "" {
+		settings.Address = ":8080"
+	}
+	defaultDuration(&settings.ReadHeaderTimeout, 5*time.Second)
+	defaultDuration(&settings.ReadTimeout, 30*time.Second)
+	defaultDuration(&settings.WriteTimeout, 30*time.Second)
+	defaultDuration(&settings.IdleTimeout, 120*time.Second)
+	defaultDuration(&settings.DrainPeriod, 5*time.Second)
+	defaultDuration(&settings.ShutdownTimeout, 30*time.Second)
+	defaultDuration(&settings.FlushTimeout, 10*time.Second)
+	defaultDuration(&settings.HealthCacheFor, 5*time.Second)
+	return settings
+}
+
+// Service runs an HTTP service: it owns the logger and the http.Server, tracks whether the
+// service is ready for traffic, and shuts down gracefully on SIGINT or SIGTERM.
+type Service struct {
+	settings ServiceSettings
+	logger   IrisLogger
+	health   *Health
+	ready    int32
+	// readySet is set by SetReady, after which Run leaves the readiness to the caller until
+	// it shuts down.
+	readySet int32
+	addr     atomic.Value
+}
+
+// NewService creates a service, and its logger unless one is given in the settings.
+func NewService(settings ServiceSettings) *Service {
+	settings = settings.withDefaults()
+	logger := settings.Logger
+	if logger == nil {
+		logger = NewLogger(settings.InstrumentationKey, settings.Name)
+	}
+	s := &Service{
+		settings: settings,
+		logger:   logger,
+		health:   NewHealth(logger, settings.HealthCacheFor),
+	}
+	s.health.SetReadiness(s.Ready)
+	return s
+}
+
+// Logger returns the service's logger, for use in its handlers.
+func (s *Service) Logger() IrisLogger {
+	return s.logger
+}
+
+// Health returns the service's health checks, served on /healthz and /readyz by Run.
+func (s *Service) Health() *Health {
+	return s.health
+}
+
+// Ready returns whether the service is accepting traffic. It is set once the service is
+// listening, unless SetReady was called, and cleared as soon as it starts shutting down.
+func (s *Service) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// SetReady overrides the readiness of the service, e.g. while a cache is warming up. Once
+// it is called, Run no longer marks the service as ready when it starts listening, so call
+// SetReady(false) before Run to start as not ready.
+func (s *Service) SetReady(ready bool) {
+	atomic.StoreInt32(&s.readySet, 1)
+	s.setReady(ready)
+}
+
+func (s *Service) setReady(ready bool) {
+	value := int32(0)
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&s.ready, value)
+}
+
+// Addr returns the address the service is listening on, or nil before it is listening.
+func (s *Service) Addr() net.Addr {
+	addr, _ := s.addr.Load().(net.Addr)
+	return addr
+}
+
+// Run serves handler, along with the health endpoints, until ctx is done, the process gets
+// SIGINT or SIGTERM, or the server fails. It then drains and shuts down: the service is
+// marked as not ready, it waits for the drain period, stops accepting connections, waits
+// for in-flight requests and finally flushes the logger by closing it, if it is a
+// ClosableLogger. Startup and shutdown are logged as info events.
+func (s *Service) Run(ctx context.Context, handler http.Handler) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if closer, ok := s.logger.(ClosableLogger); ok {
+		defer closer.Close(s.settings.FlushTimeout)
+	}
+
+	server := &http.Server{
+		Handler:           s.health.Wrap(handler),
+		ReadHeaderTimeout: s.settings.ReadHeaderTimeout,
+		ReadTimeout:       s.settings.ReadTimeout,
+		WriteTimeout:      s.settings.WriteTimeout,
+		IdleTimeout:       s.settings.IdleTimeout,
+	}
+	listener, err := net.Listen("tcp", s.settings.Address)
+	if err != nil {
+		s.logger.Error("service_start_failed", err, map[string]string{"address": s.settings.Address}, IrisLogContext{})
+		return err
+	}
+	s.addr.Store(listener.Addr())
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	if atomic.LoadInt32(&s.readySet) == 0 {
+		s.setReady(true)
+	}
+	s.logger.Info("service_started", s.settings.Name+" started", map[string]string{
+		"address": listener.Addr().String(),
+	}, IrisLogContext{})
+
+	select {
+	case err = <-serveErr:
+		s.setReady(false)
+		s.logger.Error("service_failed", err, nil, IrisLogContext{})
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	s.setReady(false)
+	s.logger.Info("service_stopping", s.settings.Name+" is draining", map[string]string{
+		"drain_period": s.settings.DrainPeriod.String(),
+	}, IrisLogContext{})
+	currentClock.Sleep(s.settings.DrainPeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.settings.ShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		s.logger.Error("service_shutdown_failed", err, nil, IrisLogContext{})
+	}
+	if serveErr := <-serveErr; !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+		err = serveErr
+	}
+	s.logger.Info("service_stopped", s.settings.Name+" stopped", nil, IrisLogContext{})
+	return err
+}
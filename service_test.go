@@ -0,0 +1,176 @@
+package goservice
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestService(logger IrisLogger) *Service {
+	return NewService(ServiceSettings{
+		Name:        "test",
+		Logger:      logger,
+		Address:     "127.0.0.1:0",
+		DrainPeriod: 10 * time.Millisecond,
+	})
+}
+
+// startService runs the service until the returned function is called, which returns the
+// error Run returned. It may be called from another goroutine than the test's.
+func startService(t *testing.T, s *Service, handler http.Handler) func() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx, handler)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Addr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the service did not start listening")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return func() error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			return errors.New("Run did not return")
+		}
+	}
+}
+
+func getStatus(t *testing.T, s *Service, path string) int {
+	response, err := http.Get("http://" + s.Addr().String() + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	return response.StatusCode
+}
+
+func TestServiceRun(t *testing.T) {
+	logger := &recordingLogger{}
+	s := newTestService(logger)
+	stop := startService(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	if !s.Ready() {
+		t.Error("the service is not ready once listening")
+	}
+	if status := getStatus(t, s, "/readyz"); status != http.StatusOK {
+		t.Errorf("got /readyz %d, want 200", status)
+	}
+	if status := getStatus(t, s, "/healthz"); status != http.StatusOK {
+		t.Errorf("got /healthz %d, want 200", status)
+	}
+	if status := getStatus(t, s, "/teapot"); status != http.StatusTeapot {
+		t.Errorf("got %d from the handler, want 418", status)
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+	if s.Ready() {
+		t.Error("the service is still ready after shutting down")
+	}
+	var events []string
+	for _, info := range logger.byKind("info") {
+		events = append(events, info.Name)
+	}
+	if len(events) != 3 || events[0] != "service_started" || events[1] != "service_stopping" || events[2] != "service_stopped" {
+		t.Errorf("logged %v, want the start and the shutdown", events)
+	}
+	if len(logger.byKind("close")) != 1 {
+		t.Error("the logger was not closed")
+	}
+}
+
+func TestServiceWaitsForInFlightRequests(t *testing.T) {
+	s := newTestService(&recordingLogger{})
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	stop := startService(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	status := make(chan int, 1)
+	go func() {
+		response, err := http.Get("http://" + s.Addr().String() + "/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		response.Body.Close()
+		status <- response.StatusCode
+	}()
+	<-started
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- stop()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("Run returned with a request in flight")
+	default:
+	}
+	if s.Ready() {
+		t.Error("the service is ready while shutting down")
+	}
+	close(finish)
+	if got := <-status; got != http.StatusAccepted {
+		t.Errorf("the in-flight request got %d, want 202", got)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func TestServiceKeepsReadinessSetBeforeRun(t *testing.T) {
+	s := newTestService(&recordingLogger{})
+	s.SetReady(false)
+	stop := startService(t, s, http.NotFoundHandler())
+	defer stop()
+
+	if s.Ready() {
+		t.Error("Run overrode SetReady(false)")
+	}
+	if status := getStatus(t, s, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("got /readyz %d, want 503", status)
+	}
+	s.SetReady(true)
+	if status := getStatus(t, s, "/readyz"); status != http.StatusOK {
+		t.Errorf("got /readyz %d once ready, want 200", status)
+	}
+}
+
+func TestServiceFailsToListen(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	logger := &recordingLogger{}
+	s := NewService(ServiceSettings{Logger: logger, Address: listener.Addr().String()})
+
+	if err := s.Run(context.Background(), http.NotFoundHandler()); err == nil {
+		t.Fatal("Run succeeded on an address in use")
+	}
+	if logged := logger.byKind("error"); len(logged) != 1 || logged[0].Name != "service_start_failed" {
+		t.Errorf("logged %v, want the failure", logged)
+	}
+	if s.Ready() {
+		t.Error("the service is ready without listening")
+	}
+}
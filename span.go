@@ -0,0 +1,93 @@
+package goservice
+
+import (
+	ctxpkg "context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DEPENDENCY_IN_PROC is the dependency type of operations logged by Span, which Application
+// Insights shows as in-process work rather than calls to other services.
+const DEPENDENCY_IN_PROC = "InProc"
+
+// Span times an operation within a request, such as a query or a calculation, and logs it
+// as a dependency when it ends. Spans nest: operations started with the context returned
+// by StartOperation are logged as its children, as is any telemetry logged with that
+// context's IrisLogContext.
+type Span struct {
+	logger  IrisLogger
+	name    string
+	context IrisLogContext
+	start   time.Time
+
+	mu    sync.Mutex
+	err   *IrisError
+	ended bool
+}
+
+// StartOperation starts a span named name, as a child of the request or operation of
+// ctx. The returned context carries the span, for nested operations and logging. The span
+// logs to the logger of ctx, see WithLogger, and is not logged if ctx has none or it is not
+// a DependencyLogger.
+func StartOperation(ctx ctxpkg.Context, name string) (ctxpkg.Context, *Span) {
+	parent := LogContextFrom(ctx)
+	context := parent
+	context.SpanId = uuid.New().String()
+	context.ParentId = parent.SpanId
+	if context.CorrelationId == "" {
+		context.CorrelationId = uuid.New().String()
+	}
+	span := &Span{
+		logger:  LoggerFrom(ctx),
+		name:    name,
+		context: context,
+		start:   currentClock.Now(),
+	}
+	return WithLogContext(ctx, context), span
+}
+
+// LogContext returns the context to log telemetry of the span with.
+func (s *Span) LogContext() IrisLogContext {
+	return s.context
+}
+
+// SetError marks the operation as failed with err. A nil err marks it as succeeded.
+func (s *Span) SetError(err *IrisError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End logs the span, with the time since it started. Only the first call has any effect.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	err := s.err
+	s.mu.Unlock()
+
+	logger, ok := s.logger.(DependencyLogger)
+	if !ok {
+		return
+	}
+	duration := currentClock.Since(s.start)
+	// The span is a dependency of the operation that started it, with the span's own id.
+	context := s.context
+	context.DependencyId, context.SpanId, context.ParentId = s.context.SpanId, s.context.ParentId, ""
+	resultCode := ""
+	if err != nil {
+		resultCode = err.Code
+		context.Properties = copyProperties(context.Properties)
+		context.Properties["error_type_code"] = err.TypeCode
+		context.Properties["error_message"] = err.Message
+		for k, v := range err.Params {
+			context.Properties["error_param_"+k] = v
+		}
+	}
+	logger.Dependency(s.name, DEPENDENCY_IN_PROC, "", duration, err == nil, resultCode, context)
+}
@@ -0,0 +1,70 @@
+package goservice
+
+import (
+	"context"
+	"testing"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+func TestSpanIsLoggedAsDependencyOfItsParent(t *testing.T) {
+	logger := &recordingLogger{}
+	request := IrisLogContext{CorrelationId: "correlation", SpanId: "request"}
+	ctx := WithLogger(WithLogContext(context.Background(), request), logger)
+
+	ctx, outer := StartOperation(ctx, "outer")
+	_, inner := StartOperation(ctx, "inner")
+	inner.SetError(BadRequest("invalid", "invalid input", nil))
+	inner.End()
+	outer.End()
+
+	dependencies := logger.byKind("dependency")
+	if len(dependencies) != 2 {
+		t.Fatalf("got %d dependencies, want 2", len(dependencies))
+	}
+	innerContext, outerContext := dependencies[0].Context, dependencies[1].Context
+	if outerContext.DependencyId != outer.LogContext().SpanId || outerContext.SpanId != "request" {
+		t.Errorf("outer span logged with id %q under %q, want %q under the request", outerContext.DependencyId, outerContext.SpanId, outer.LogContext().SpanId)
+	}
+	if innerContext.DependencyId != inner.LogContext().SpanId || innerContext.SpanId != outer.LogContext().SpanId {
+		t.Errorf("inner span logged with id %q under %q, want %q under the outer span", innerContext.DependencyId, innerContext.SpanId, inner.LogContext().SpanId)
+	}
+	if dependencies[0].Success || innerContext.Properties["error_type_code"] != ERROR_BAD_REQUEST {
+		t.Errorf("inner span logged as %+v, want the error", dependencies[0])
+	}
+}
+
+func TestDependenciesGetTheirOwnIds(t *testing.T) {
+	pipeline := NewTelemetryPipeline(PipelineSettings{})
+	logger := irisLogClient{client: appinsights.NewTelemetryClient("ikey"), pipeline: pipeline}
+	request := IrisLogContext{CorrelationId: "correlation", SpanId: "request", ParentId: "caller"}
+
+	logger.Dependency("attempt 1", "retry", "", 0, false, "", request)
+	logger.Dependency("attempt 2", "retry", "", 0, true, "", request)
+	span := request
+	span.DependencyId = "span"
+	logger.Dependency("operation", DEPENDENCY_IN_PROC, "", 0, true, "", span)
+
+	items := pipeline.take(3)
+	if len(items) != 3 {
+		t.Fatalf("got %d items, want 3", len(items))
+	}
+	ids := map[string]bool{}
+	for _, item := range items {
+		data := item.Envelope.Data.(*contracts.Data).BaseData.(*contracts.RemoteDependencyData)
+		if data.Id == "" || data.Id == "request" || ids[data.Id] {
+			t.Errorf("dependency %s has id %q, want a new one", data.Name, data.Id)
+		}
+		ids[data.Id] = true
+		if parent := item.Envelope.Tags[contracts.OperationParentId]; parent != "request" {
+			t.Errorf("dependency %s has parent %q, want the request", data.Name, parent)
+		}
+		if operation := item.Envelope.Tags[contracts.OperationId]; operation != "correlation" {
+			t.Errorf("dependency %s has operation %q, want the correlation id", data.Name, operation)
+		}
+	}
+	if !ids["span"] {
+		t.Error("the DependencyId was not used")
+	}
+}
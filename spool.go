@@ -0,0 +1,338 @@
+package goservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// spoolSegmentItems is the most items written to one spool file.
+const spoolSegmentItems = 1000
+
+// spoolFileSuffix ends the names of spool files, which start with the time they were
+// created in nanoseconds, so that they sort in the order they were written.
+const spoolFileSuffix = ".jsonl"
+
+// spoolTempSuffix ends the names of files being written, which are renamed once complete.
+const spoolTempSuffix = ".tmp"
+
+var errSpoolFull = errors.New("spool is full")
+var errSpoolClosed = errors.New("spool is closed")
+
+// spool keeps telemetry items in files in a directory, one JSON item per line, until they
+// can be sent.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	// expired counts the items removed for being older than maxAge.
+	expired int64
+
+	mu        sync.Mutex
+	bytes     int64
+	seq       int
+	file      *os.File
+	fileItems int
+	closed    bool
+}
+
+func newSpool(dir string, maxBytes int64, maxAge time.Duration) *spool {
+	s := &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+	for _, name := range s.files() {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			s.bytes += info.Size()
+		}
+	}
+	return s
+}
+
+// files returns the names of the spool files, oldest first.
+func (s *spool) files() []string {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolFileSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// empty returns whether the spool has no files.
+func (s *spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files()) == 0
+}
+
+// newName returns the name of a new spool file.
+func (s *spool) newName() string {
+	s.seq++
+	return fmt.Sprintf("%020d-%06d%s", currentClock.Now().UnixNano(), s.seq, spoolFileSuffix)
+}
+
+// spoolFileTime returns the time a spool file was created, from its name.
+func spoolFileTime(name string) (time.Time, bool) {
+	nanos, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+func encodeSpoolItems(items []pipelineItem) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, item := range items {
+		if err := encoder.Encode(item); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func decodeSpoolItems(data []byte) []pipelineItem {
+	var items []pipelineItem
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var item pipelineItem
+		// A line cut short by a crash is skipped.
+		if json.Unmarshal(scanner.Bytes(), &item) == nil && item.Envelope != nil {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// write appends an item to the file being written, starting a new one when it is full.
+func (s *spool) write(item pipelineItem) error {
+	line, err := encodeSpoolItems([]pipelineItem{item})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSpoolClosed
+	}
+	if s.bytes+int64(len(line)) > s.maxBytes {
+		return errSpoolFull
+	}
+	if s.file == nil {
+		if err := os.MkdirAll(s.dir, 0o755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filepath.Join(s.dir, s.newName()), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		s.file, s.fileItems = file, 0
+	}
+	// Lines are written unbuffered, so they are kept if the process dies.
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	s.bytes += int64(len(line))
+	s.fileItems++
+	if s.fileItems >= spoolSegmentItems {
+		s.closeFile()
+	}
+	return nil
+}
+
+// writeBatch writes the items to a file of their own.
+func (s *spool) writeBatch(items []pipelineItem) error {
+	data, err := encodeSpoolItems(items)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSpoolClosed
+	}
+	if s.bytes+int64(len(data)) > s.maxBytes {
+		return errSpoolFull
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	if err := s.replaceFile(s.newName(), data); err != nil {
+		return err
+	}
+	s.bytes += int64(len(data))
+	return nil
+}
+
+// replaceFile writes data to the named file, so that the file is either left as it was or
+// has all of data.
+func (s *spool) replaceFile(name string, data []byte) error {
+	path := filepath.Join(s.dir, name)
+	if err := os.WriteFile(path+spoolTempSuffix, data, 0o644); err != nil {
+		os.Remove(path + spoolTempSuffix)
+		return err
+	}
+	return os.Rename(path+spoolTempSuffix, path)
+}
+
+// closeFile finishes the file being written, so that it can be read.
+func (s *spool) closeFile() {
+	if s.file == nil {
+		return
+	}
+	s.file.Close()
+	s.file = nil
+}
+
+// oldest returns the name and items of the oldest spool file, removing files that are
+// older than maxAge. It returns false if the spool is empty.
+func (s *spool) oldest() (string, []pipelineItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.files() {
+		path := filepath.Join(s.dir, name)
+		if s.file != nil && s.file.Name() == path {
+			s.closeFile()
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", nil, false
+		}
+		items := decodeSpoolItems(data)
+		if created, ok := spoolFileTime(name); ok && s.maxAge > 0 && currentClock.Since(created) > s.maxAge {
+			if os.Remove(path) == nil {
+				s.bytes -= int64(len(data))
+				atomic.AddInt64(&s.expired, int64(len(items)))
+			}
+			continue
+		}
+		return name, items, true
+	}
+	return "", nil, false
+}
+
+// remove removes a spool file whose items were sent.
+func (s *spool) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := filepath.Join(s.dir, name)
+	if info, err := os.Stat(path); err == nil && os.Remove(path) == nil {
+		s.bytes -= info.Size()
+	}
+}
+
+// rewrite replaces the items of a spool file with those that are left to send.
+func (s *spool) rewrite(name string, items []pipelineItem) error {
+	data, err := encodeSpoolItems(items)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	if err := s.replaceFile(name, data); err != nil {
+		return err
+	}
+	s.bytes += int64(len(data)) - info.Size()
+	return nil
+}
+
+func (s *spool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeFile()
+	s.closed = true
+}
+
+// SpoolInfo describes the telemetry in a spool directory.
+type SpoolInfo struct {
+	Files int
+	Items int
+	Bytes int64
+	// Oldest and Newest are the creation times of the oldest and newest files.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// InspectSpool describes the telemetry spooled in dir by a TelemetryPipeline.
+func InspectSpool(dir string) (SpoolInfo, error) {
+	info := SpoolInfo{}
+	if _, err := os.Stat(dir); err != nil {
+		return info, err
+	}
+	s := newSpool(dir, math.MaxInt64, 0)
+	for _, name := range s.files() {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return info, err
+		}
+		info.Files++
+		info.Items += len(decodeSpoolItems(data))
+		info.Bytes += int64(len(data))
+		if created, ok := spoolFileTime(name); ok {
+			if info.Oldest.IsZero() || created.Before(info.Oldest) {
+				info.Oldest = created
+			}
+			if created.After(info.Newest) {
+				info.Newest = created
+			}
+		}
+	}
+	return info, nil
+}
+
+// DrainSpool sends the telemetry spooled in dir to the Application Insights endpoint, or
+// the default one if endpoint is empty, oldest first. Each file is removed once the
+// endpoint has accepted or refused all of its items. It stops at the first file with items
+// that may be accepted later, which are kept. It returns the number of items accepted, and
+// the number refused, which won't be sent again, with the error of the file it stopped at,
+// or else of the last refusal. The directory should not be in use by a running logger.
+func DrainSpool(dir string, endpoint string) (int, int, error) {
+	sink := newHTTPSink(endpoint, nil)
+	s := newSpool(dir, math.MaxInt64, 0)
+	var result error
+	for _, name := range s.files() {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			result = err
+			break
+		}
+		retry, err := sink.send(decodeSpoolItems(data))
+		if len(retry) > 0 {
+			result = err
+			if rewriteErr := s.rewrite(name, retry); rewriteErr != nil {
+				result = rewriteErr
+			}
+			break
+		}
+		s.remove(name)
+		if err != nil {
+			result = err
+		}
+	}
+	stats := PipelineStats{}
+	sink.addStats(&stats)
+	return int(stats.Accepted), int(stats.Rejected), result
+}
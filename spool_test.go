@@ -0,0 +1,259 @@
+package goservice
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// spoolNames returns the names of the items.
+func spoolNames(items []pipelineItem) []string {
+	names := []string{}
+	for _, item := range items {
+		names = append(names, item.Envelope.Name)
+	}
+	return names
+}
+
+// spoolSize returns the size of the files in dir.
+func spoolSize(t *testing.T, dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+	return size
+}
+
+func TestSpoolWriteAndOldest(t *testing.T) {
+	dir := t.TempDir()
+	s := newSpool(dir, math.MaxInt64, time.Hour)
+	if _, _, ok := s.oldest(); ok {
+		t.Fatal("an empty spool has an oldest file")
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := s.write(testItem(name, contracts.Information)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.writeBatch([]pipelineItem{testItem("c", contracts.Information)}); err != nil {
+		t.Fatal(err)
+	}
+	if s.bytes != spoolSize(t, dir) {
+		t.Errorf("got %d bytes, want the size of the files %d", s.bytes, spoolSize(t, dir))
+	}
+	if reopened := newSpool(dir, math.MaxInt64, time.Hour); reopened.bytes != s.bytes {
+		t.Errorf("got %d bytes in the reopened spool, want %d", reopened.bytes, s.bytes)
+	}
+
+	var got [][]string
+	for {
+		name, items, ok := s.oldest()
+		if !ok {
+			break
+		}
+		got = append(got, spoolNames(items))
+		s.remove(name)
+	}
+	if want := [][]string{{"a", "b"}, {"c"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %v, want %v", got, want)
+	}
+	if s.bytes != 0 || !s.empty() {
+		t.Errorf("got %d bytes left, want none", s.bytes)
+	}
+}
+
+func TestSpoolExpiresOldFiles(t *testing.T) {
+	clock := useFakeClock(t)
+	s := newSpool(t.TempDir(), math.MaxInt64, time.Hour)
+	s.writeBatch([]pipelineItem{testItem("a", contracts.Information), testItem("b", contracts.Information)})
+	clock.Increment(30 * time.Minute)
+	s.writeBatch([]pipelineItem{testItem("c", contracts.Information)})
+	clock.Increment(31 * time.Minute)
+
+	_, items, ok := s.oldest()
+	if !ok || !reflect.DeepEqual(spoolNames(items), []string{"c"}) {
+		t.Errorf("got %v, want only the file within the max age", items)
+	}
+	if s.expired != 2 {
+		t.Errorf("got %d expired, want 2", s.expired)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	line, _ := encodeSpoolItems([]pipelineItem{testItem("a", contracts.Information)})
+	s := newSpool(t.TempDir(), int64(2*len(line)), time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := s.write(testItem("a", contracts.Information)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.write(testItem("a", contracts.Information)); err != errSpoolFull {
+		t.Errorf("got %v, want the spool full", err)
+	}
+	if err := s.writeBatch([]pipelineItem{testItem("a", contracts.Information)}); err != errSpoolFull {
+		t.Errorf("got %v for a batch, want the spool full", err)
+	}
+	s.close()
+	if err := s.write(testItem("a", contracts.Information)); err != errSpoolClosed {
+		t.Errorf("got %v, want the spool closed", err)
+	}
+}
+
+func TestSpoolRewrite(t *testing.T) {
+	dir := t.TempDir()
+	s := newSpool(dir, math.MaxInt64, time.Hour)
+	s.writeBatch([]pipelineItem{testItem("a", contracts.Information), testItem("b", contracts.Information), testItem("c", contracts.Information)})
+	name, items, _ := s.oldest()
+	if err := s.rewrite(name, items[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	_, items, _ = s.oldest()
+	if got := spoolNames(items); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("got %v, want the items left to send", got)
+	}
+	if s.bytes != spoolSize(t, dir) {
+		t.Errorf("got %d bytes, want the size of the files %d", s.bytes, spoolSize(t, dir))
+	}
+}
+
+func TestSpoolSkipsTruncatedLines(t *testing.T) {
+	dir := t.TempDir()
+	s := newSpool(dir, math.MaxInt64, time.Hour)
+	s.write(testItem("a", contracts.Information))
+	s.write(testItem("b", contracts.Information))
+	// A crash while writing c leaves part of its line.
+	s.file.WriteString(`{"severity":1,"envelope":{"na`)
+
+	_, items, ok := s.oldest()
+	if !ok || !reflect.DeepEqual(spoolNames(items), []string{"a", "b"}) {
+		t.Errorf("got %v, want the complete lines", items)
+	}
+}
+
+func TestInspectSpool(t *testing.T) {
+	clock := useFakeClock(t)
+	dir := t.TempDir()
+	if _, err := InspectSpool(filepath.Join(dir, "missing")); err == nil {
+		t.Error("inspecting a missing directory succeeded")
+	}
+	if info, err := InspectSpool(dir); err != nil || info != (SpoolInfo{}) {
+		t.Errorf("got %+v, %v for an empty directory", info, err)
+	}
+
+	s := newSpool(dir, math.MaxInt64, time.Hour)
+	first := clock.Now()
+	s.writeBatch([]pipelineItem{testItem("a", contracts.Information), testItem("b", contracts.Information)})
+	clock.Increment(time.Minute)
+	s.writeBatch([]pipelineItem{testItem("c", contracts.Information)})
+
+	info, err := InspectSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SpoolInfo{Files: 2, Items: 3, Bytes: spoolSize(t, dir), Oldest: first, Newest: first.Add(time.Minute)}
+	if !info.Oldest.Equal(want.Oldest) || !info.Newest.Equal(want.Newest) {
+		t.Errorf("got %v to %v, want %v to %v", info.Oldest, info.Newest, want.Oldest, want.Newest)
+	}
+	info.Oldest, info.Newest, want.Oldest, want.Newest = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	if info != want {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+}
+
+func TestDrainSpool(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantSent     int
+		wantRejected int
+		wantError    bool
+		wantItems    int
+	}{
+		{"accepted", http.StatusOK, 3, 0, false, 0},
+		{"refused", http.StatusBadRequest, 0, 3, true, 0},
+		{"unavailable", http.StatusServiceUnavailable, 0, 0, true, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, _ := ingestionServer(t, test.status)
+			dir := t.TempDir()
+			s := newSpool(dir, math.MaxInt64, time.Hour)
+			s.writeBatch([]pipelineItem{testItem("a", contracts.Information), testItem("b", contracts.Information)})
+			s.writeBatch([]pipelineItem{testItem("c", contracts.Information)})
+
+			sent, rejected, err := DrainSpool(dir, server.URL)
+			if sent != test.wantSent || rejected != test.wantRejected || (err != nil) != test.wantError {
+				t.Errorf("got %d sent, %d rejected, %v", sent, rejected, err)
+			}
+			if info, _ := InspectSpool(dir); info.Items != test.wantItems {
+				t.Errorf("got %d items left, want %d", info.Items, test.wantItems)
+			}
+		})
+	}
+}
+
+func TestPipelineSendsSpooledItemsFirst(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var names []string
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			envelope := contracts.Envelope{}
+			json.Unmarshal(scanner.Bytes(), &envelope)
+			names = append(names, envelope.Name)
+		}
+		mu.Lock()
+		batches = append(batches, names)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	s := newSpool(dir, math.MaxInt64, time.Hour)
+	s.writeBatch([]pipelineItem{testItem("spooled", contracts.Information)})
+	s.close()
+
+	pipeline := NewTelemetryPipeline(PipelineSettings{SpoolDir: dir})
+	logger := NewLogger("ikey", "test", WithEndpoint(server.URL), WithPipeline(pipeline))
+	logger.Info("started", "started", nil, IrisLogContext{})
+	// Closing with a backlog would spool the queue, so wait for the backlog to be sent.
+	for deadline := time.Now().Add(5 * time.Second); !pipeline.spool.empty() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	logger.(ClosableLogger).Close(5 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 2 || !reflect.DeepEqual(batches[0], []string{"spooled"}) || len(batches[1]) != 1 {
+		t.Errorf("got batches %v, want the spooled item before the one logged", batches)
+	}
+	if info, _ := InspectSpool(dir); info.Items != 0 {
+		t.Errorf("got %d items left in the spool", info.Items)
+	}
+}
@@ -0,0 +1,154 @@
+package goservice
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HEADER_REQUEST_TIMEOUT lets an upstream caller pass on how much of its own deadline is
+// left, either as a number of milliseconds or as a Go duration string such as `1.5s`.
+const HEADER_REQUEST_TIMEOUT = "X-Request-Timeout"
+
+// RequestTimeout returns a middleware that gives the handler at most timeout to finish,
+// or less if the request's X-Request-Timeout header asks for it. The request context gets
+// a matching deadline, so downstream calls made with it are cancelled too.
+//
+// If the handler overruns, a `timeout.handler` error is returned straight away and the
+// handler is left to notice the cancelled context. Its writes are buffered until it
+// finishes, so a late handler never writes to the response alongside the error, and the
+// request telemetry gets a `timed_out` property. Panics in the handler are passed on.
+func RequestTimeout(timeout time.Duration) Middleware {
+	return func(next HttpRequestHandlerFunc) HttpRequestHandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, logContext IrisLogContext) *IrisError {
+			limit := timeout
+			if upstream, ok := upstreamTimeout(r); ok && (limit <= 0 || upstream < limit) {
+				limit = upstream
+			}
+			if limit <= 0 {
+				return next(w, r, logContext)
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), limit)
+			defer cancel()
+
+			// The handler gets its own properties, which are only merged back if it
+			// finishes in time, so that a late handler can't race with request logging.
+			handlerContext := logContext
+			handlerContext.Properties = copyProperties(logContext.Properties)
+			tw := &timeoutWriter{header: http.Header{}}
+			done := make(chan *IrisError, 1)
+			panics := make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panics <- p
+					}
+				}()
+				done <- next(tw, r.WithContext(WithLogContext(ctx, handlerContext)), handlerContext)
+			}()
+
+			select {
+			case p := <-panics:
+				panic(p)
+			case err := <-done:
+				if logContext.Properties != nil {
+					for k, v := range handlerContext.Properties {
+						logContext.Properties[k] = v
+					}
+				}
+				tw.flushTo(w)
+				return err
+			case <-ctx.Done():
+				tw.timeOut()
+				if logContext.Properties != nil {
+					logContext.Properties["timed_out"] = "true"
+					logContext.Properties["timeout"] = limit.String()
+				}
+				return Timeout("handler", "request did not finish within "+limit.String(), map[string]string{
+					"timeout": limit.String(),
+				})
+			}
+		}
+	}
+}
+
+// upstreamTimeout parses the X-Request-Timeout header.
+func upstreamTimeout(r *http.Request) (time.Duration, bool) {
+	value := r.Header.Get(HEADER_REQUEST_TIMEOUT)
+	if value == "" {
+		return 0, false
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d, true
+	}
+	return 0, false
+}
+
+func copyProperties(properties map[string]string) map[string]string {
+	copied := make(map[string]string, len(properties))
+	for k, v := range properties {
+		copied[k] = v
+	}
+	return copied
+}
+
+// timeoutWriter buffers a handler's response until it is known to have finished in time.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.body.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
+
+func (tw *timeoutWriter) timeOut() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.timedOut = true
+}
+
+func (tw *timeoutWriter) flushTo(w http.ResponseWriter) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for k, v := range tw.header {
+		w.Header()[k] = v
+	}
+	// A handler that wrote nothing leaves the response to HttpRequestHandler, which
+	// writes the error it returned, if any.
+	if tw.status == 0 {
+		return
+	}
+	w.WriteHeader(tw.status)
+	w.Write(tw.body.Bytes())
+}
@@ -0,0 +1,76 @@
+package goservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeoutPassesErrorsToHttpRequestHandler(t *testing.T) {
+	handler := NewChain(RequestTimeout(time.Second)).Handler(func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+		return TooManyRequests("slow_down", "too many requests", map[string]string{PARAM_RETRY_AFTER: "5"})
+	}, &recordingLogger{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("got status %d, want 429", response.StatusCode)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", contentType)
+	}
+	if retryAfter := response.Header.Get("Retry-After"); retryAfter != "5" {
+		t.Errorf("got Retry-After %q, want 5", retryAfter)
+	}
+	body := IrisError{}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "too_many_requests.slow_down" {
+		t.Errorf("got code %q in the body", body.Code)
+	}
+}
+
+func TestRequestTimeoutKeepsWrittenResponses(t *testing.T) {
+	handler := NewChain(RequestTimeout(time.Second)).Handler(func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+		return nil
+	}, &recordingLogger{})
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", nil))
+
+	if recorder.Code != http.StatusCreated || recorder.Body.String() != "created" {
+		t.Errorf("got %d %q, want 201 created", recorder.Code, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/plain" {
+		t.Errorf("got Content-Type %q, want text/plain", contentType)
+	}
+}
+
+func TestRequestTimeoutTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handler := NewChain(RequestTimeout(10*time.Millisecond)).Handler(func(w http.ResponseWriter, r *http.Request, context IrisLogContext) *IrisError {
+		<-release
+		w.Write([]byte("late"))
+		return nil
+	}, &recordingLogger{})
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/", nil))
+
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("got status %d, want 504", recorder.Code)
+	}
+}
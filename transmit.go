@@ -0,0 +1,187 @@
+package goservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_ENDPOINT is the Application Insights ingestion endpoint.
+const DEFAULT_ENDPOINT = "https://dc.services.visualstudio.com/v2/track"
+
+// httpSinkTimeout bounds a send when no http.Client is given, so that a hung endpoint
+// doesn't stall the pipeline, or DrainSpool.
+const httpSinkTimeout = 30 * time.Second
+
+// httpSink sends telemetry to an Application Insights ingestion endpoint, in the format
+// of the Application Insights channel.
+type httpSink struct {
+	endpoint string
+	client   *http.Client
+
+	accepted  int64
+	rejected  int64
+	throttled int64
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// throttledError is the error of a send that the endpoint throttled, with the time it
+// asked to wait for.
+type throttledError struct {
+	status int
+	until  time.Time
+}
+
+func (err *throttledError) Error() string {
+	if err.until.IsZero() {
+		return fmt.Sprintf("ingestion throttled with %d", err.status)
+	}
+	return fmt.Sprintf("ingestion throttled with %d until %s", err.status, err.until.Format(time.RFC3339))
+}
+
+// addStats adds the results of the sends to stats.
+func (sink *httpSink) addStats(stats *PipelineStats) {
+	stats.Accepted = atomic.LoadInt64(&sink.accepted)
+	stats.Rejected = atomic.LoadInt64(&sink.rejected)
+	stats.Throttled = atomic.LoadInt64(&sink.throttled)
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	stats.LastError = sink.lastError
+	stats.LastErrorAt = sink.lastErrorAt
+}
+
+func (sink *httpSink) recordError(err error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.lastError = err.Error()
+	sink.lastErrorAt = currentClock.Now()
+}
+
+// retryAfter reads the Retry-After header of a response, which is either a number of
+// seconds or a date.
+func retryAfter(response *http.Response) (time.Time, bool) {
+	value := response.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return currentClock.Now().Add(time.Duration(seconds) * time.Second), true
+	}
+	if until, err := http.ParseTime(value); err == nil {
+		return until, true
+	}
+	return time.Time{}, false
+}
+
+func newHTTPSink(endpoint string, client *http.Client) *httpSink {
+	if endpoint == "" {
+		endpoint = DEFAULT_ENDPOINT
+	}
+	if client == nil {
+		client = &http.Client{Timeout: httpSinkTimeout}
+	}
+	return &httpSink{endpoint: endpoint, client: client}
+}
+
+// ingestionResponse is the body of an ingestion endpoint's response.
+type ingestionResponse struct {
+	ItemsReceived int                      `json:"itemsReceived"`
+	ItemsAccepted int                      `json:"itemsAccepted"`
+	Errors        []ingestionResponseError `json:"errors"`
+}
+
+type ingestionResponseError struct {
+	Index      int    `json:"index"`
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message"`
+}
+
+// retryableIngestionStatus returns whether a status, of a response or of an item in it,
+// means that the items may be accepted if sent again.
+func retryableIngestionStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, 439,
+		http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+func (sink *httpSink) send(items []pipelineItem) ([]pipelineItem, error) {
+	retry, err := sink.post(items)
+	if err != nil {
+		sink.recordError(err)
+	}
+	return retry, err
+}
+
+func (sink *httpSink) post(items []pipelineItem) ([]pipelineItem, error) {
+	var payload bytes.Buffer
+	writer := gzip.NewWriter(&payload)
+	encoder := json.NewEncoder(writer)
+	for _, item := range items {
+		if err := encoder.Encode(item.Envelope); err != nil {
+			return nil, fmt.Errorf("encoding telemetry: %w", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("compressing telemetry: %w", err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, sink.endpoint, &payload)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Encoding", "gzip")
+	request.Header.Set("Content-Type", "application/x-json-stream")
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return items, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return items, err
+	}
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+		atomic.AddInt64(&sink.accepted, int64(len(items)))
+		return nil, nil
+	case response.StatusCode == http.StatusPartialContent:
+		result := ingestionResponse{}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return items, fmt.Errorf("reading partial ingestion response: %w", err)
+		}
+		atomic.AddInt64(&sink.accepted, int64(result.ItemsAccepted))
+		var retry []pipelineItem
+		for _, itemErr := range result.Errors {
+			if retryableIngestionStatus(itemErr.StatusCode) && itemErr.Index >= 0 && itemErr.Index < len(items) {
+				retry = append(retry, items[itemErr.Index])
+			} else {
+				atomic.AddInt64(&sink.rejected, 1)
+			}
+		}
+		if len(result.Errors) > 0 {
+			err = fmt.Errorf("ingestion accepted %d of %d items: %s", result.ItemsAccepted, result.ItemsReceived, result.Errors[0].Message)
+		}
+		return retry, err
+	case retryableIngestionStatus(response.StatusCode):
+		until, ok := retryAfter(response)
+		if ok || response.StatusCode == http.StatusTooManyRequests || response.StatusCode == 439 {
+			atomic.AddInt64(&sink.throttled, 1)
+			return items, &throttledError{status: response.StatusCode, until: until}
+		}
+		return items, fmt.Errorf("ingestion responded %d", response.StatusCode)
+	default:
+		atomic.AddInt64(&sink.rejected, int64(len(items)))
+		return nil, fmt.Errorf("ingestion rejected the telemetry with %d: %s", response.StatusCode, body)
+	}
+}
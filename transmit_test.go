@@ -0,0 +1,20 @@
+package goservice
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewHTTPSinkDefaultsToAClientWithATimeout(t *testing.T) {
+	sink := newHTTPSink("", nil)
+	if sink.client == http.DefaultClient || sink.client.Timeout <= 0 {
+		t.Error("the default client can wait forever for the endpoint")
+	}
+	if sink.endpoint != DEFAULT_ENDPOINT {
+		t.Errorf("got endpoint %q, want the default", sink.endpoint)
+	}
+	client := &http.Client{}
+	if newHTTPSink("http://localhost", client).client != client {
+		t.Error("the given client was not used")
+	}
+}
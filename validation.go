@@ -0,0 +1,279 @@
+package goservice
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationErrors builds a bad request error out of problems with individual fields.
+// Each field is identified by a JSON pointer (RFC 6901) into the request body, e.g.
+// `/items/0/name`, and is sent to the client as an item of the error's Errors.
+// The zero value is ready to use.
+type ValidationErrors struct {
+	list ErrorList
+}
+
+// Add records that the field at path broke rule. The rule becomes the subcode of the
+// field's error, and the rule and rejected value are added to its params.
+func (v *ValidationErrors) Add(path string, rule string, message string, value interface{}) {
+	params := map[string]string{"rule": rule}
+	if value != nil {
+		params["value"] = fmt.Sprint(value)
+	}
+	v.list.Add(path, BadRequest(rule, message, params))
+}
+
+// Len returns the number of invalid fields recorded.
+func (v *ValidationErrors) Len() int {
+	return v.list.Len()
+}
+
+// Err returns nil if no field is invalid, and a `bad_request.validation_failed` error
+// holding each field error otherwise.
+func (v *ValidationErrors) Err() *IrisError {
+	err := v.list.Err()
+	if err == nil {
+		return nil
+	}
+	err.Code = errCode(ERROR_BAD_REQUEST, "validation_failed")
+	err.Message = "request validation failed"
+	return err
+}
+
+// JSONPointer joins the tokens into a JSON pointer, escaping `~` and `/` as required.
+func JSONPointer(tokens ...string) string {
+	output := strings.Builder{}
+	for _, token := range tokens {
+		output.WriteString("/")
+		token = strings.ReplaceAll(token, "~", "~0")
+		output.WriteString(strings.ReplaceAll(token, "/", "~1"))
+	}
+	return output.String()
+}
+
+// Validate checks a struct against the rules in its `validate` tags, and returns a
+// validation error listing every field that broke a rule, or nil if none did.
+// Field paths use the names from the `json` tags so they match the request body.
+// Nested structs, pointers, slices and maps are validated recursively.
+//
+// The supported rules, separated by commas, are:
+//   - required: the field must not be the zero value
+//   - min=N, max=N: bounds for numbers, or for the length of strings, slices and maps
+//   - oneof=a b c: the field must be one of the space separated values
+//
+// Rules other than required are skipped for nil pointers, interfaces, slices and maps, so
+// that optional fields can be left out. Other fields are always checked, so a zero `int`
+// breaks `min=18`.
+//
+// A tag using an unknown rule or a malformed argument returns an internal service error,
+// since that is a bug in the service rather than in the request.
+func Validate(value interface{}) *IrisError {
+	v := &ValidationErrors{}
+	if err := validateValue(v, reflect.ValueOf(value), nil); err != nil {
+		return err
+	}
+	return v.Err()
+}
+
+func validateValue(v *ValidationErrors, value reflect.Value, path []string) *IrisError {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.Struct:
+		return validateStruct(v, value, path)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := validateValue(v, value.Index(i), append(path, strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			if err := validateValue(v, iter.Value(), append(path, fmt.Sprint(iter.Key().Interface()))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateStruct(v *ValidationErrors, value reflect.Value, path []string) *IrisError {
+	structType := value.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		name, ok := jsonFieldName(field)
+		if !ok {
+			continue
+		}
+		fieldValue := value.Field(i)
+		// Embedded structs without a json name are flattened into the parent object.
+		if field.Anonymous && name == "" {
+			if err := validateValue(v, fieldValue, path); err != nil {
+				return err
+			}
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), name)
+		if tag := field.Tag.Get("validate"); tag != "" {
+			valid, err := validateField(v, fieldValue, fieldPath, tag)
+			if err != nil {
+				return err
+			}
+			if !valid {
+				continue
+			}
+		}
+		if err := validateValue(v, fieldValue, fieldPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonFieldName returns the name a field is encoded with, and false if it is skipped.
+// Embedded structs without an explicit name return an empty name.
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name := strings.Split(tag, ",")[0]
+	if name != "" {
+		return name, true
+	}
+	if field.Anonymous && indirectType(field.Type).Kind() == reflect.Struct {
+		return "", true
+	}
+	if field.PkgPath != "" {
+		return "", false
+	}
+	return field.Name, true
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// validateField applies each rule of the tag to the field, recording the first rule that
+// fails. It returns whether the field passed.
+func validateField(v *ValidationErrors, value reflect.Value, path []string, tag string) (bool, *IrisError) {
+	pointer := JSONPointer(path...)
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+		if name != "required" && isAbsent(value) {
+			// Optional fields that are absent are not checked against other rules.
+			continue
+		}
+		message, err := checkRule(value, name, arg)
+		if err != nil {
+			return false, InternalService("invalid_validation_tag", err.Error(), map[string]string{
+				"field": pointer,
+				"rule":  rule,
+			})
+		}
+		if message != "" {
+			var rejected interface{}
+			if name != "required" && value.CanInterface() {
+				rejected = reflect.Indirect(value).Interface()
+			}
+			v.Add(pointer, name, message, rejected)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isAbsent returns whether the value is a nil pointer, interface, slice or map, which is
+// how an optional field is left out. Zero numbers and empty strings are not absent.
+func isAbsent(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return value.IsNil()
+	}
+	return false
+}
+
+func isNilOrZero(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return value.IsNil()
+	}
+	return value.IsZero()
+}
+
+// checkRule returns a message describing why the value breaks the rule, or an empty
+// string if it doesn't.
+func checkRule(value reflect.Value, rule string, arg string) (string, error) {
+	switch rule {
+	case "required":
+		if isNilOrZero(value) {
+			return "is required", nil
+		}
+		return "", nil
+	case "min", "max":
+		bound, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s argument %q", rule, arg)
+		}
+		actual, isLength, ok := measure(reflect.Indirect(value))
+		if !ok {
+			return "", fmt.Errorf("%s cannot be applied to %s", rule, value.Type())
+		}
+		subject := "must be"
+		if isLength {
+			subject = "length must be"
+		}
+		if rule == "min" && actual < bound {
+			return fmt.Sprintf("%s at least %s", subject, arg), nil
+		}
+		if rule == "max" && actual > bound {
+			return fmt.Sprintf("%s at most %s", subject, arg), nil
+		}
+		return "", nil
+	case "oneof":
+		actual := fmt.Sprint(reflect.Indirect(value).Interface())
+		for _, option := range strings.Fields(arg) {
+			if actual == option {
+				return "", nil
+			}
+		}
+		return fmt.Sprintf("must be one of [%s]", strings.Join(strings.Fields(arg), ", ")), nil
+	default:
+		return "", fmt.Errorf("unknown validation rule %q", rule)
+	}
+}
+
+// measure returns the number a min or max rule compares against, and whether that
+// number is a length.
+func measure(value reflect.Value) (float64, bool, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(value.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), false, true
+	case reflect.String:
+		return float64(utf8.RuneCountInString(value.String())), true, true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), true, true
+	}
+	return 0, false, false
+}
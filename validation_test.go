@@ -0,0 +1,52 @@
+package goservice
+
+import "testing"
+
+func TestValidateChecksZeroScalars(t *testing.T) {
+	type request struct {
+		Age  int    `json:"age" validate:"min=18"`
+		Plan string `json:"plan" validate:"oneof=free pro"`
+	}
+
+	err := Validate(request{})
+	if err == nil {
+		t.Fatal("Validate accepted zero values that break min and oneof")
+	}
+	if len(err.Errors) != 2 {
+		t.Fatalf("got %d field errors, want 2: %v", len(err.Errors), err.Errors)
+	}
+	if err.Errors[0].Field != "/age" || err.Errors[1].Field != "/plan" {
+		t.Errorf("got fields %q and %q", err.Errors[0].Field, err.Errors[1].Field)
+	}
+}
+
+func TestValidateSkipsAbsentOptionalFields(t *testing.T) {
+	type request struct {
+		Age  *int              `json:"age" validate:"min=18"`
+		Tags []string          `json:"tags" validate:"min=1"`
+		Meta map[string]string `json:"meta" validate:"max=2"`
+	}
+
+	if err := Validate(request{}); err != nil {
+		t.Errorf("Validate rejected absent optional fields: %v", err)
+	}
+
+	age := 0
+	if err := Validate(request{Age: &age}); err == nil {
+		t.Error("Validate accepted a present field that breaks min")
+	}
+}
+
+func TestValidateRequired(t *testing.T) {
+	type request struct {
+		Name string `json:"name" validate:"required,min=2"`
+	}
+
+	err := Validate(request{})
+	if err == nil || len(err.Errors) != 1 {
+		t.Fatalf("Validate returned %v, want one field error", err)
+	}
+	if !err.Errors[0].PrefixMatches(ERROR_BAD_REQUEST, "required") {
+		t.Errorf("field error has code %q, want the required rule", err.Errors[0].Code)
+	}
+}